@@ -0,0 +1,166 @@
+// Package auth implements API keys with scoped permissions.
+//
+// Keys are only stored as SHA-256 hashes. Since keys are random and long, a
+// single unsalted hash is enough to make a leaked key file useless.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Scope is a permission granted to a key
+type Scope string
+
+const (
+	ScopeReprice Scope = "reprice" // update prices
+	ScopeProduct Scope = "product" // read the last price of a product
+	ScopeQuery   Scope = "query"   // read the price history
+
+	// ScopeProvenance allows reading the provenance of records with the
+	// query endpoint, which also requires ScopeQuery
+	ScopeProvenance Scope = "provenance"
+)
+
+// Principal is the identity of an authenticated client
+type Principal struct {
+	Name            string   `json:"name"`
+	Scopes          []Scope  `json:"scopes"`
+	ProductPrefixes []string `json:"productPrefixes,omitempty"` // if not empty, only matching products may be accessed
+}
+
+// Allowed reports whether the principal has been granted a scope
+func (p *Principal) Allowed(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted reports whether the principal may only access some products
+func (p *Principal) Restricted() bool { return len(p.ProductPrefixes) > 0 }
+
+// AllowedProduct reports whether the principal may access a product
+func (p *Principal) AllowedProduct(productId string) bool {
+	if !p.Restricted() {
+		return true
+	}
+
+	for _, prefix := range p.ProductPrefixes {
+		if strings.HasPrefix(productId, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys maps API keys to the principals they authenticate
+type Keys struct {
+	byHash map[string]*Principal
+}
+
+// keyHashPrefix identifies the hash function in key files
+const keyHashPrefix = "sha256:"
+
+// HashKey returns the hash of an API key, as stored in a key file
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return keyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// LoadKeys reads a key file, which is a JSON array of principals, each with a
+// "keyHash" field as returned by HashKey, e.g.:
+//
+//	[{"name": "pricing", "keyHash": "sha256:...", "scopes": ["reprice"], "productPrefixes": ["acme-"]}]
+func LoadKeys(path string) (*Keys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := ParseKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseKeys parses the contents of a key file
+func ParseKeys(data []byte) (*Keys, error) {
+	var entries []struct {
+		Principal
+		KeyHash string `json:"keyHash"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	keys := &Keys{byHash: make(map[string]*Principal, len(entries))}
+	names := make(map[string]bool, len(entries))
+
+	for i := range entries {
+		e := &entries[i]
+
+		if e.Name == "" {
+			return nil, fmt.Errorf("key %d has no name", i)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("duplicate key name %q", e.Name)
+		}
+		names[e.Name] = true
+
+		hash := strings.ToLower(e.KeyHash)
+		digest, err := hex.DecodeString(strings.TrimPrefix(hash, keyHashPrefix))
+		if !strings.HasPrefix(hash, keyHashPrefix) || err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("key %q: keyHash must be %q followed by a hex encoded SHA-256 digest", e.Name, keyHashPrefix)
+		}
+		if _, exists := keys.byHash[hash]; exists {
+			return nil, fmt.Errorf("key %q: duplicate keyHash", e.Name)
+		}
+
+		for _, scope := range e.Scopes {
+			switch scope {
+			case ScopeReprice, ScopeProduct, ScopeQuery, ScopeProvenance:
+			default:
+				return nil, fmt.Errorf("key %q: unknown scope %q", e.Name, scope)
+			}
+		}
+
+		principal := e.Principal
+		keys.byHash[hash] = &principal
+	}
+
+	return keys, nil
+}
+
+// Authenticate returns the principal of a key, or false if the key is unknown
+func (k *Keys) Authenticate(key string) (*Principal, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	// the lookup is by hash, so its timing reveals nothing about valid keys
+	p, ok := k.byHash[HashKey(key)]
+	return p, ok
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying an authenticated principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, or nil if the request
+// wasn't authenticated
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	keys, err := ParseKeys([]byte(`[
+		{"name": "pricing", "keyHash": "` + HashKey("secret") + `", "scopes": ["reprice", "product"], "productPrefixes": ["acme-"]},
+		{"name": "reporting", "keyHash": "` + HashKey("other") + `", "scopes": ["query"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := keys.Authenticate("wrong"); ok {
+		t.Error("unknown keys should not authenticate")
+	}
+	if _, ok := keys.Authenticate(""); ok {
+		t.Error("empty keys should not authenticate")
+	}
+
+	p, ok := keys.Authenticate("secret")
+	if !ok || p.Name != "pricing" {
+		t.Fatal("key should authenticate its principal", p)
+	}
+
+	if !p.Allowed(ScopeReprice) || p.Allowed(ScopeQuery) {
+		t.Error("principal should only be allowed its scopes", p.Scopes)
+	}
+
+	if !p.AllowedProduct("acme-1") || p.AllowedProduct("other-1") {
+		t.Error("principal should only be allowed products matching its prefixes")
+	}
+
+	if p, _ := keys.Authenticate("other"); p.Restricted() || !p.AllowedProduct("other-1") {
+		t.Error("principal without prefixes should be allowed all products")
+	}
+
+	if FromContext(NewContext(context.Background(), p)) != p || FromContext(context.Background()) != nil {
+		t.Error("principal should be carried by context")
+	}
+}
+
+func TestParseKeysInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{}`,
+		`[{"keyHash": "` + HashKey("secret") + `", "scopes": ["reprice"]}]`,
+		`[{"name": "plain", "keyHash": "secret", "scopes": ["reprice"]}]`,
+		`[{"name": "admin", "keyHash": "` + HashKey("secret") + `", "scopes": ["admin"]}]`,
+		`[{"name": "a", "keyHash": "` + HashKey("secret") + `"}, {"name": "a", "keyHash": "` + HashKey("other") + `"}]`,
+		`[{"name": "a", "keyHash": "` + HashKey("secret") + `"}, {"name": "b", "keyHash": "` + HashKey("secret") + `"}]`,
+	} {
+		if _, err := ParseKeys([]byte(data)); err == nil {
+			t.Error("key file should be rejected", data)
+		}
+	}
+}
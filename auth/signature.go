@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+// SignatureError describes why a request signature was rejected
+type SignatureError string
+
+const (
+	SignatureMissing   SignatureError = "missing"   // no signature headers
+	SignatureMalformed SignatureError = "malformed" // unparseable timestamp, nonce or signature
+	SignatureExpired   SignatureError = "expired"   // timestamp outside of the window
+	SignatureInvalid   SignatureError = "invalid"   // doesn't match any active secret
+	SignatureReplayed  SignatureError = "replayed"  // nonce was already used
+)
+
+func (e SignatureError) Error() string        { return "signature " + string(e) }
+func (SignatureError) ErrorCode() errors.Code { return errors.Unauthorized }
+
+const maxNonceLength = 128
+
+// SignatureVerifier verifies HMAC-SHA256 signatures of request bodies made
+// with shared secrets.
+//
+// A signature covers a timestamp, a nonce and the body. Requests are only
+// accepted within a window around their timestamp, and each nonce is only
+// accepted once within that window, so signed requests can't be replayed.
+// Multiple secrets can be active at once, so that they can be rotated.
+type SignatureVerifier struct {
+	sync.Mutex
+	secrets   map[string][]byte // by ID
+	window    time.Duration
+	notBefore time.Time            // timestamps before this are expired regardless of the window
+	nonces    map[string]time.Time // nonces of accepted requests, with their timestamps
+	lastSweep time.Time
+}
+
+// NewSignatureVerifier constructs a verifier accepting signatures made with
+// any of the given secrets, with timestamps up to window before or after the
+// current time
+func NewSignatureVerifier(secrets map[string][]byte, window time.Duration) *SignatureVerifier {
+	return &SignatureVerifier{
+		secrets: secrets,
+		window:  window,
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// LoadSecrets reads a JSON object mapping secret IDs to secrets
+func LoadSecrets(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%s: no secrets", path)
+	}
+
+	ret := make(map[string][]byte, len(secrets))
+	for id, secret := range secrets {
+		if id == "" {
+			return nil, fmt.Errorf("%s: secret IDs must not be empty", path)
+		}
+		if len(secret) < sha256.Size {
+			return nil, fmt.Errorf("%s: secret %q must be at least %d bytes", path, id, sha256.Size)
+		}
+		ret[id] = []byte(secret)
+	}
+	return ret, nil
+}
+
+// Sign returns the hex encoded signature of a body, as sent by clients
+func Sign(secret []byte, timestamp time.Time, nonce string, body []byte) string {
+	return hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), nonce, body))
+}
+
+func mac(secret []byte, timestamp, nonce string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	_, _ = h.Write(body)
+	return h.Sum(nil)
+}
+
+// SetSecrets replaces the active secrets and the window, while keeping track
+// of the nonces which were already used
+func (v *SignatureVerifier) SetSecrets(secrets map[string][]byte, window time.Duration, now time.Time) {
+	v.Lock()
+	defer v.Unlock()
+
+	// nonces older than the previous window may have been forgotten, so
+	// requests that old must not be accepted by a longer window
+	if window > v.window {
+		if floor := now.Add(-v.window); floor.After(v.notBefore) {
+			v.notBefore = floor
+		}
+	}
+
+	v.secrets = secrets
+	v.window = window
+}
+
+// Verify checks the signature of a body, given the timestamp (in Unix
+// seconds), nonce and signature sent with it. It returns the ID of the secret
+// that made the signature, or a SignatureError.
+func (v *SignatureVerifier) Verify(timestamp, nonce, signature string, body []byte, now time.Time) (secretID string, err error) {
+	if timestamp == "" && nonce == "" && signature == "" {
+		return "", SignatureMissing
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" || len(nonce) > maxNonceLength {
+		return "", SignatureMalformed
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", SignatureMalformed
+	}
+
+	v.Lock()
+	secrets, window, notBefore := v.secrets, v.window, v.notBefore
+	v.Unlock()
+
+	t := time.Unix(unix, 0)
+	if t.Before(now.Add(-window)) || t.After(now.Add(window)) || t.Before(notBefore) {
+		return "", SignatureExpired
+	}
+
+	found := false
+	for id, secret := range secrets {
+		if hmac.Equal(sig, mac(secret, timestamp, nonce, body)) {
+			secretID, found = id, true
+			break
+		}
+	}
+	if !found {
+		return "", SignatureInvalid
+	}
+
+	// nonces are only recorded once the signature is known to be valid,
+	// so that unauthenticated clients can't fill up the cache
+	if !v.useNonce(nonce, t, now) {
+		return "", SignatureReplayed
+	}
+
+	return secretID, nil
+}
+
+// useNonce records a nonce, returning false if it was already used
+func (v *SignatureVerifier) useNonce(nonce string, t, now time.Time) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	// nonces of requests that are outside of the window can be forgotten,
+	// since those requests will be rejected anyway
+	if now.Sub(v.lastSweep) > v.window {
+		for n, nt := range v.nonces {
+			if nt.Before(now.Add(-v.window)) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if _, used := v.nonces[nonce]; used {
+		return false
+	}
+	v.nonces[nonce] = t
+	return true
+}
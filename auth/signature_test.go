@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	v := NewSignatureVerifier(map[string][]byte{"old": []byte("old secret"), "new": []byte("new secret")}, time.Minute)
+	now := time.Now()
+	body := []byte(`{"productId":"foo","price":3.50}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	if id, err := v.Verify(ts, "n1", Sign([]byte("old secret"), now, "n1", body), body, now); err != nil || id != "old" {
+		t.Error("signature made with an active secret should be accepted", id, err)
+	}
+
+	if id, err := v.Verify(ts, "n2", Sign([]byte("new secret"), now, "n2", body), body, now); err != nil || id != "new" {
+		t.Error("all active secrets should be accepted", id, err)
+	}
+
+	for _, c := range []struct {
+		timestamp, nonce, signature string
+		body                        []byte
+		err                         SignatureError
+	}{
+		{"", "", "", body, SignatureMissing},
+		{"yesterday", "n3", Sign([]byte("new secret"), now, "n3", body), body, SignatureMalformed},
+		{ts, "", Sign([]byte("new secret"), now, "", body), body, SignatureMalformed},
+		{ts, "n3", "not hex", body, SignatureMalformed},
+		{strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10), "n3", Sign([]byte("new secret"), now.Add(-2*time.Minute), "n3", body), body, SignatureExpired},
+		{ts, "n3", Sign([]byte("wrong secret"), now, "n3", body), body, SignatureInvalid},
+		{ts, "n3", Sign([]byte("new secret"), now, "n3", body), []byte(`{"productId":"foo","price":0.01}`), SignatureInvalid},
+		{ts, "n1", Sign([]byte("new secret"), now, "n1", body), body, SignatureReplayed},
+	} {
+		if _, err := v.Verify(c.timestamp, c.nonce, c.signature, c.body, now); err != c.err {
+			t.Error("signature should be rejected as", c.err, "not", err, c)
+		}
+	}
+
+	// once the original request is outside the window, the nonce is
+	// forgotten, and a replay would be rejected as expired instead
+	later := now.Add(3 * time.Minute)
+	lts := strconv.FormatInt(later.Unix(), 10)
+	if _, err := v.Verify(lts, "n4", Sign([]byte("new secret"), later, "n4", body), body, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, used := v.nonces["n1"]; used {
+		t.Error("expired nonces should be forgotten")
+	}
+}
+
+func TestSignatureVerifierSetSecrets(t *testing.T) {
+	v := NewSignatureVerifier(map[string][]byte{"old": []byte("old secret")}, time.Minute)
+	now := time.Now()
+	body := []byte(`{"productId":"foo","price":3.50}`)
+	sign := func(secret string, t time.Time, nonce string) (string, string) {
+		return strconv.FormatInt(t.Unix(), 10), Sign([]byte(secret), t, nonce, body)
+	}
+
+	ts, sig := sign("old secret", now, "n1")
+	if _, err := v.Verify(ts, "n1", sig, body, now); err != nil {
+		t.Fatal(err)
+	}
+
+	v.SetSecrets(map[string][]byte{"new": []byte("new secret")}, 10*time.Minute, now)
+
+	if _, err := v.Verify(ts, "n2", Sign([]byte("old secret"), now, "n2", body), body, now); err != SignatureInvalid {
+		t.Error("removed secrets should be rejected", err)
+	}
+	ts, sig = sign("new secret", now, "n1")
+	if _, err := v.Verify(ts, "n1", sig, body, now); err != SignatureReplayed {
+		t.Error("nonces should be remembered across updates", err)
+	}
+
+	// the nonces of requests older than the previous window may have been
+	// forgotten, so the longer window only applies to newer requests
+	ts, sig = sign("new secret", now.Add(-5*time.Minute), "n3")
+	if _, err := v.Verify(ts, "n3", sig, body, now); err != SignatureExpired {
+		t.Error("requests older than the previous window should be rejected", err)
+	}
+	ts, sig = sign("new secret", now.Add(5*time.Minute), "n4")
+	if _, err := v.Verify(ts, "n4", sig, body, now); err != nil {
+		t.Error("the longer window should apply to newer requests", err)
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repricer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := strings.Repeat("s", 32)
+	file := filepath.Join(dir, "secrets.json")
+
+	_ = ioutil.WriteFile(file, []byte(`{"current": "`+secret+`"}`), 0666)
+	if secrets, err := LoadSecrets(file); err != nil || string(secrets["current"]) != secret {
+		t.Error("secrets should be loaded by ID", secrets, err)
+	}
+
+	for _, invalid := range []string{
+		`{}`,
+		`{"": "` + secret + `"}`,
+		`{"short": "secret"}`,
+	} {
+		_ = ioutil.WriteFile(file, []byte(invalid), 0666)
+		if _, err := LoadSecrets(file); err == nil {
+			t.Error("invalid secrets should be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nothingmuch/repricer/storage"
+)
+
+// backup writes a tar archive of a data directory to stdout or a file. Like
+// fsck it's safe to run against the data directory of a live server.
+func backup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer backup [data directory]")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "write to this `file` instead of stdout, compressed unless it ends with .tar")
+	compress := flags.Bool("z", false, "gzip compress the archive written to stdout")
+	timeout := flags.Duration("timeout", time.Minute, "how long to wait for the files being written to be finalized")
+	_ = flags.Parse(args)
+
+	dir, ok := dataDir(flags)
+	if !ok {
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+		*compress = !strings.HasSuffix(*output, ".tar")
+	}
+
+	buf := bufio.NewWriter(w)
+	w = buf
+	var zw *gzip.Writer
+	if *compress {
+		zw = gzip.NewWriter(buf)
+		w = zw
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	lastFileSeq, err := storage.Backup(ctx, storage.OS(dir), w, storage.BackupOptions{})
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup aborted:", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "backed up results files up to fileSeq %d\n", lastFileSeq)
+
+	return 0
+}
+
+// restore extracts an archive written by backup into a new data directory
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer restore [data directory]")
+		flags.PrintDefaults()
+	}
+	input := flags.String("i", "", "read from this `file` instead of stdin")
+	_ = flags.Parse(args)
+
+	var opts storage.Options
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		// the directory is created if it doesn't exist
+		opts.Path = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		r = f
+	}
+
+	files, err := storage.Restore(context.Background(), opts, r)
+
+	fmt.Fprintf(os.Stderr, "restored %d results files\n", files)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore aborted:", err)
+		return 1
+	}
+
+	return 0
+}
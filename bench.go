@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/handlers"
+)
+
+// benchOptions configures a load test
+type benchOptions struct {
+	url           string        // base URL of the server
+	concurrency   int           // number of concurrent clients
+	requests      int           // total number of requests, 0 if unbounded
+	products      int           // number of distinct products
+	reads         float64       // fraction of requests that read prices
+	apiKey        string        // sent with every request if not empty
+	signingSecret string        // if not empty reprice requests are signed with it
+	client        *http.Client  // by default http.DefaultClient
+	timeout       time.Duration // of each request
+}
+
+// benchResult summarizes a load test
+type benchResult struct {
+	elapsed   time.Duration
+	statuses  map[int]int // number of responses by status code
+	errors    int         // requests that failed without a response
+	latencies []time.Duration
+}
+
+// bench load tests a running server with a mix of reprice requests and reads
+// of the product endpoint, and reports throughput and latency
+func bench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer bench [url]")
+		flags.PrintDefaults()
+	}
+	opts := benchOptions{url: "http://localhost:8080"}
+	flags.IntVar(&opts.concurrency, "c", 10, "number of concurrent clients")
+	flags.IntVar(&opts.requests, "n", 0, "total number of requests, if 0 only -d limits the test")
+	duration := flags.Duration("d", 10*time.Second, "duration of the test")
+	flags.IntVar(&opts.products, "products", 100, "number of distinct products to update and read")
+	flags.Float64Var(&opts.reads, "reads", 0.5, "fraction of requests that read a price instead of updating it")
+	flags.StringVar(&opts.apiKey, "api-key", os.Getenv("REPRICER_BENCH_API_KEY"), "API `key` sent with every request")
+	flags.StringVar(&opts.signingSecret, "signing-secret", os.Getenv("REPRICER_BENCH_SIGNING_SECRET"), "`secret` used to sign reprice requests")
+	flags.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of each request")
+	_ = flags.Parse(args)
+
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		opts.url = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if opts.concurrency < 1 || opts.products < 1 || opts.reads < 0 || opts.reads > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	result := runBench(ctx, opts)
+	result.print(os.Stdout)
+
+	if result.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runBench(ctx context.Context, opts benchOptions) benchResult {
+	if opts.client == nil {
+		opts.client = http.DefaultClient
+	}
+
+	// requests are handed out by a single channel, so that -n is exact
+	work := make(chan struct{})
+	go func() {
+		defer close(work)
+		for i := 0; opts.requests == 0 || i < opts.requests; i++ {
+			select {
+			case work <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		mu     sync.Mutex
+		result = benchResult{statuses: make(map[int]int)}
+		wg     sync.WaitGroup
+	)
+	start := time.Now()
+
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := mathrand.New(mathrand.NewSource(seed))
+
+			for range work {
+				req := opts.request(rng)
+
+				t := time.Now()
+				status, err := opts.do(req)
+				latency := time.Since(t)
+
+				mu.Lock()
+				if err != nil {
+					result.errors++
+				} else {
+					result.statuses[status]++
+					result.latencies = append(result.latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+
+	wg.Wait()
+	result.elapsed = time.Since(start)
+
+	return result
+}
+
+// request constructs a random request
+func (opts benchOptions) request(rng *mathrand.Rand) *http.Request {
+	productId := fmt.Sprintf("bench-%d", rng.Intn(opts.products))
+	base := strings.TrimSuffix(opts.url, "/")
+
+	var req *http.Request
+	if rng.Float64() < opts.reads {
+		req, _ = http.NewRequest("GET", base+"/api/product/"+productId+"/price", nil)
+	} else {
+		body := []byte(fmt.Sprintf(`{"productId":%q,"price":%.2f}`, productId, 1+rng.Float64()*100))
+		req, _ = http.NewRequest("POST", base+"/api/reprice", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		if opts.signingSecret != "" {
+			nonce := make([]byte, 16)
+			_, _ = rand.Read(nonce)
+			now := time.Now()
+			req.Header.Set(handlers.SignatureTimestampHeader, fmt.Sprint(now.Unix()))
+			req.Header.Set(handlers.SignatureNonceHeader, hex.EncodeToString(nonce))
+			req.Header.Set(handlers.SignatureHeader, auth.Sign([]byte(opts.signingSecret), now, hex.EncodeToString(nonce), body))
+		}
+	}
+
+	if opts.apiKey != "" {
+		req.Header.Set(handlers.APIKeyHeader, opts.apiKey)
+	}
+
+	return req
+}
+
+func (opts benchOptions) do(req *http.Request) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	resp, err := opts.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the body is read so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func (r benchResult) print(w io.Writer) {
+	n := len(r.latencies) + r.errors
+	fmt.Fprintf(w, "%d requests in %v, %.1f requests/s\n", n, r.elapsed.Round(time.Millisecond), float64(n)/r.elapsed.Seconds())
+
+	var statuses []int
+	for status := range r.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "  %d %s: %d\n", status, http.StatusText(status), r.statuses[status])
+	}
+	if r.errors > 0 {
+		fmt.Fprintf(w, "  errors: %d\n", r.errors)
+	}
+
+	if len(r.latencies) == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	fmt.Fprintf(w, "latency p50 %v, p90 %v, p99 %v, max %v\n",
+		r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.latencies[len(r.latencies)-1])
+}
+
+// percentile returns a percentile of the latencies, which must be sorted
+func (r benchResult) percentile(p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nothingmuch/repricer/handlers"
+)
+
+func TestBench(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		methods = make(map[string]int)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		methods[req.Method]++
+		mu.Unlock()
+
+		if req.Header.Get(handlers.APIKeyHeader) != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if req.Method == "POST" && req.Header.Get(handlers.SignatureHeader) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if req.Method == "POST" {
+			w.WriteHeader(http.StatusAccepted)
+		} else if strings.HasPrefix(req.URL.Path, "/api/product/bench-") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	result := runBench(context.Background(), benchOptions{
+		url:           server.URL,
+		concurrency:   4,
+		requests:      100,
+		products:      10,
+		reads:         0.5,
+		apiKey:        "key",
+		signingSecret: "secret",
+		timeout:       time.Second,
+	})
+
+	if len(result.latencies) != 100 || result.errors != 0 {
+		t.Fatal("exactly -n requests should be made", len(result.latencies), result.errors)
+	}
+	if result.statuses[http.StatusAccepted] != methods["POST"] || result.statuses[http.StatusNotFound] != methods["GET"] || methods["POST"] == 0 || methods["GET"] == 0 {
+		t.Error("updates and reads should be mixed, with keys and signatures", result.statuses, methods)
+	}
+
+	var out bytes.Buffer
+	result.print(&out)
+	if !strings.HasPrefix(out.String(), "100 requests in ") || !strings.Contains(out.String(), "latency p50") {
+		t.Error("summary should describe the requests", out.String())
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nothingmuch/repricer/handlers"
+	"github.com/nothingmuch/repricer/storage"
+)
+
+// config is the runtime configuration of the server. Every field can be set
+// in a JSON file, in an environment variable or with a flag, in increasing
+// order of precedence. Environment variables are named after the flags, e.g.
+// REPRICER_DATA_DIR for -data-dir.
+//
+// Fields tagged with reload:"restart" can't be changed by reloading the
+// configuration while the server is running.
+type config struct {
+	Addr          string `json:"addr" reload:"restart"`
+	BackplaneAddr string `json:"backplaneAddr" reload:"restart"`
+	AdminAddr     string `json:"adminAddr" reload:"restart"`
+	DataDir       string `json:"dataDir" reload:"restart"`
+
+	Durable   bool     `json:"durable"`
+	Standby   bool     `json:"standby" reload:"restart"`
+	QueueWait duration `json:"queueWait"`
+
+	APIKeys         string        `json:"apiKeys"`
+	SigningSecrets  string        `json:"signingSecrets"`
+	SignatureWindow duration      `json:"signatureWindow"`
+	RateLimits      rateLimitFlag `json:"rateLimits"`
+	MaxInFlight     int           `json:"maxInFlight"`
+	PageSize        int           `json:"pageSize"`
+
+	MaxRecordsPerFile int      `json:"maxRecordsPerFile" reload:"restart"`
+	FlushInterval     duration `json:"flushInterval" reload:"restart"`
+	WriteQueueLength  int      `json:"writeQueueLength" reload:"restart"`
+
+	LogLevel string `json:"logLevel"`
+}
+
+// envPrefix is prepended to the upper cased flag names to form the names of
+// environment variables
+const envPrefix = "REPRICER_"
+
+func defaultConfig() config {
+	return config{
+		Addr:            ":8080",
+		BackplaneAddr:   ":9102",
+		AdminAddr:       "localhost:9103",
+		DataDir:         ".",
+		SignatureWindow: duration(5 * time.Minute),
+		RateLimits: rateLimitFlag{
+			"reprice": {Rate: 100, Burst: 200},
+			"product": {Rate: 100, Burst: 200},
+			"query":   {Rate: 10, Burst: 20},
+		},
+		MaxInFlight:       handlers.DefaultMaxInFlight,
+		PageSize:          handlers.DefaultPageSize,
+		MaxRecordsPerFile: storage.DefaultMaxRecordsPerFile,
+		FlushInterval:     duration(storage.DefaultFlushInterval),
+		WriteQueueLength:  storage.DefaultWriteQueueLength,
+		LogLevel:          "info",
+	}
+}
+
+// flags defines a flag for every field of c, as well as -config
+func (c *config) flags(name string, configFile *string) *flag.FlagSet {
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	f.StringVar(configFile, "config", *configFile, "JSON `file` with configuration, overridden by environment variables and flags")
+
+	f.StringVar(&c.Addr, "addr", c.Addr, "listen address of the API")
+	f.StringVar(&c.BackplaneAddr, "backplane-addr", c.BackplaneAddr, "listen address of health checks and metrics")
+	f.StringVar(&c.AdminAddr, "admin-addr", c.AdminAddr, "listen address of the unauthenticated administrative endpoints, which should only be reachable locally, if empty they are disabled")
+	f.StringVar(&c.DataDir, "data-dir", c.DataDir, "data directory")
+
+	f.BoolVar(&c.Durable, "durable", c.Durable, "wait for new prices to be stored before responding to reprice requests")
+	f.BoolVar(&c.Standby, "standby", c.Standby, "if the data directory is locked, wait to take over instead of exiting")
+	f.DurationVar((*time.Duration)(&c.QueueWait), "queue-wait", time.Duration(c.QueueWait), "how long reprice requests may wait for write capacity before being rejected")
+
+	f.StringVar(&c.APIKeys, "api-keys", c.APIKeys, "JSON file of hashed API keys and their permissions, if empty authentication is disabled")
+	f.StringVar(&c.SigningSecrets, "signing-secrets", c.SigningSecrets, "JSON file of active HMAC secrets by ID, if not empty reprice requests must be signed")
+	f.DurationVar((*time.Duration)(&c.SignatureWindow), "signature-window", time.Duration(c.SignatureWindow), "how far the timestamp of a signed request may be from the current time")
+	f.Var(c.RateLimits, "rate-limit", "per client rate limit of an `endpoint=rate[:burst]` in requests per second, 0 disables limiting (repeatable, or comma separated)")
+	f.IntVar(&c.MaxInFlight, "max-in-flight", c.MaxInFlight, "maximum number of concurrent requests to the product and query endpoints, each")
+	f.IntVar(&c.PageSize, "page-size", c.PageSize, "default number of entries returned by the query endpoint")
+
+	f.IntVar(&c.MaxRecordsPerFile, "max-records-per-file", c.MaxRecordsPerFile, "maximum number of records in a results file")
+	f.DurationVar((*time.Duration)(&c.FlushInterval), "flush-interval", time.Duration(c.FlushInterval), "how long a results file accepts new records before it's synced")
+	f.IntVar(&c.WriteQueueLength, "write-queue-length", c.WriteQueueLength, "number of accepted records which may be waiting to be written")
+
+	f.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of log entries to write (debug, info, warn or error)")
+
+	return f
+}
+
+// loadConfig builds the configuration from the defaults, the JSON file named
+// by -config or REPRICER_CONFIG, environment variables, and finally the
+// command line arguments. It returns the remaining arguments.
+func loadConfig(name string, args []string, lookupEnv func(string) (string, bool)) (c config, rest []string, err error) {
+	// the flags are parsed once just to find the config file, since they
+	// take precedence over it
+	configFile, _ := lookupEnv(envName("config"))
+	scratch := defaultConfig()
+	if err := scratch.flags(name, &configFile).Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	c = defaultConfig()
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return c, nil, err
+		}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&c); err != nil {
+			return c, nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+
+		// unlike the flag, the JSON object isn't checked while decoding
+		if c.RateLimits == nil {
+			c.RateLimits = rateLimitFlag{}
+		}
+		if err := c.RateLimits.validate(); err != nil {
+			return c, nil, fmt.Errorf("%s: rateLimits: %w", configFile, err)
+		}
+	}
+
+	f := c.flags(name, &configFile)
+	f.VisitAll(func(fl *flag.Flag) {
+		if value, ok := lookupEnv(envName(fl.Name)); ok && err == nil {
+			if err = f.Set(fl.Name, value); err != nil {
+				err = fmt.Errorf("%s: %w", envName(fl.Name), err)
+			}
+		}
+	})
+	if err != nil {
+		return c, nil, err
+	}
+
+	f.SetOutput(ioutil.Discard) // usage was already printed by the first pass
+	if err := f.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	return c, f.Args(), nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// storageOptions returns the options of the storage model, without a logger
+func (c config) storageOptions() storage.Options {
+	return storage.Options{
+		Path:              c.DataDir,
+		Standby:           c.Standby,
+		MaxRecordsPerFile: c.MaxRecordsPerFile,
+		FlushInterval:     time.Duration(c.FlushInterval),
+		WriteQueueLength:  c.WriteQueueLength,
+	}
+}
+
+// duration is a time.Duration which is written as a string in JSON, e.g. "5m"
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+// rateLimitFlag parses rate limits of endpoints, and defines the defaults
+type rateLimitFlag map[string]handlers.RateLimit
+
+func (f rateLimitFlag) String() string {
+	var limits []string
+	for endpoint, limit := range f {
+		limits = append(limits, fmt.Sprintf("%s=%g:%d", endpoint, limit.Rate, limit.Burst))
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (f rateLimitFlag) Set(value string) error {
+	for _, limit := range strings.Split(value, ",") {
+		if err := f.set(limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f rateLimitFlag) set(value string) (err error) {
+	i := strings.IndexByte(value, '=')
+	if i == -1 {
+		return fmt.Errorf("missing endpoint in %q", value)
+	}
+	endpoint, spec := value[:i], value[i+1:]
+
+	var limit handlers.RateLimit
+	rate, burst := spec, ""
+	if i := strings.IndexByte(spec, ':'); i != -1 {
+		rate, burst = spec[:i], spec[i+1:]
+	}
+
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return fmt.Errorf("invalid rate in %q", value)
+	}
+
+	if burst != "" {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 1 {
+			return fmt.Errorf("invalid burst in %q", value)
+		}
+	}
+
+	f[endpoint] = limit
+	return f.validate()
+}
+
+// validate checks the limits, whether they were set by flags or decoded from
+// JSON, and gives the ones without a burst the default one
+func (f rateLimitFlag) validate() error {
+	for endpoint, limit := range f {
+		switch endpoint {
+		case "reprice", "product", "query":
+		default:
+			return fmt.Errorf("unknown endpoint %q", endpoint)
+		}
+
+		if !(limit.Rate >= 0) || math.IsInf(limit.Rate, 1) {
+			return fmt.Errorf("invalid rate %g for %s", limit.Rate, endpoint)
+		}
+
+		if limit.Burst < 0 {
+			return fmt.Errorf("invalid burst %d for %s", limit.Burst, endpoint)
+		} else if limit.Burst == 0 {
+			// by default allow a burst of one second's worth of
+			// requests, but at least one request
+			limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+			f[endpoint] = limit
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repricer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(file, []byte(`{
+		"addr": ":1",
+		"dataDir": "/from/file",
+		"flushInterval": "2s",
+		"pageSize": 5,
+		"rateLimits": {"query": {"rate": 1, "burst": 2}}
+	}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"REPRICER_CONFIG":     file,
+		"REPRICER_DATA_DIR":   "/from/env",
+		"REPRICER_PAGE_SIZE":  "6",
+		"REPRICER_RATE_LIMIT": "reprice=3:4,product=5",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	c, rest, err := loadConfig("repricer", []string{"-page-size", "7", "-durable", "extra"}, lookupEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Addr != ":1" || time.Duration(c.FlushInterval) != 2*time.Second {
+		t.Error("file should override defaults", c.Addr, c.FlushInterval)
+	}
+	if c.DataDir != "/from/env" {
+		t.Error("environment should override file", c.DataDir)
+	}
+	if c.PageSize != 7 || !c.Durable {
+		t.Error("flags should override environment", c.PageSize, c.Durable)
+	}
+	if c.BackplaneAddr != ":9102" || c.AdminAddr != "localhost:9103" || c.WriteQueueLength != 50 {
+		t.Error("unset fields should have defaults", c.BackplaneAddr, c.AdminAddr, c.WriteQueueLength)
+	}
+
+	expected := rateLimitFlag{
+		"query":   {Rate: 1, Burst: 2},
+		"reprice": {Rate: 3, Burst: 4},
+		"product": {Rate: 5, Burst: 5},
+	}
+	if c.RateLimits.String() != expected.String() {
+		t.Error("rate limits should be merged", c.RateLimits)
+	}
+
+	if len(rest) != 1 || rest[0] != "extra" {
+		t.Error("remaining arguments should be returned", rest)
+	}
+
+	env["REPRICER_PAGE_SIZE"] = "many"
+	if _, _, err := loadConfig("repricer", nil, lookupEnv); err == nil {
+		t.Error("invalid environment variables should be rejected")
+	}
+
+	delete(env, "REPRICER_PAGE_SIZE")
+	_ = ioutil.WriteFile(file, []byte(`{"pageSize": 5, "typo": 1}`), 0666)
+	if _, _, err := loadConfig("repricer", nil, lookupEnv); err == nil {
+		t.Error("unknown fields in the config file should be rejected")
+	}
+
+	for _, rateLimits := range []string{
+		`{"typo": {"rate": 1}}`,
+		`{"query": {"rate": -1}}`,
+		`{"query": {"rate": 1, "burst": -1}}`,
+	} {
+		_ = ioutil.WriteFile(file, []byte(`{"rateLimits": `+rateLimits+`}`), 0666)
+		if _, _, err := loadConfig("repricer", nil, lookupEnv); err == nil {
+			t.Error("invalid rate limits in the config file should be rejected", rateLimits)
+		}
+	}
+
+	_ = ioutil.WriteFile(file, []byte(`{"rateLimits": {"query": {"rate": 3}}}`), 0666)
+	if c, _, err := loadConfig("repricer", nil, lookupEnv); err != nil || c.RateLimits["query"].Burst != 3 {
+		t.Error("rate limits in the config file should have the default burst", c.RateLimits, err)
+	}
+
+	for rate, burst := range map[string]int{"0.5": 1, "2.5": 3} {
+		_ = ioutil.WriteFile(file, []byte(`{"rateLimits": {"query": {"rate": `+rate+`}}}`), 0666)
+		if c, _, err := loadConfig("repricer", nil, lookupEnv); err != nil || c.RateLimits["query"].Burst != burst {
+			t.Error("the default burst should be the rate rounded up, and at least 1", rate, c.RateLimits, err)
+		}
+	}
+}
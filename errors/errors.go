@@ -1,18 +1,237 @@
+// Package errors provides error types which carry a machine readable Code,
+// which determines how they are reported to clients, along with the context
+// of the failure (a path or field) and the underlying cause.
+//
+// The functions of the standard library's errors package are also provided,
+// since this package shadows its name.
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Code is a stable machine readable classification of an error. Codes are
+// errors themselves, so that Is(err, NotFound) reports whether err has that
+// code.
+type Code string
+
+const (
+	Invalid       Code = "invalid_request" // the input is invalid
+	Malformed     Code = "malformed_body"  // the input can't be parsed
+	InvalidMethod Code = "invalid_method"  // the operation isn't supported by the resource
+	Unauthorized  Code = "unauthorized"    // the client isn't authenticated
+	Forbidden     Code = "forbidden"       // the client may not perform the operation
+	NotFound      Code = "not_found"       // the resource doesn't exist
+	RateLimited   Code = "rate_limited"    // the client made too many requests
+	Unavailable   Code = "unavailable"     // temporary failure, the operation may be retried
+	Unsupported   Code = "not_implemented" // the operation isn't implemented
+	Corrupt       Code = "corrupt"         // stored data is invalid
+	Internal      Code = "internal_error"  // any other failure
+)
+
+// TODO 405 for InvalidMethod, with an Allow header, would be more appropriate
+// but would change the API
+var statuses = map[Code]int{
+	Invalid:       http.StatusBadRequest,
+	Malformed:     http.StatusBadRequest,
+	InvalidMethod: http.StatusBadRequest,
+	Unauthorized:  http.StatusUnauthorized,
+	Forbidden:     http.StatusForbidden,
+	NotFound:      http.StatusNotFound,
+	RateLimited:   http.StatusTooManyRequests,
+	Unavailable:   http.StatusServiceUnavailable,
+	Unsupported:   http.StatusNotImplemented,
+}
+
+func (c Code) Error() string { return string(c) }
+
+// Status is the HTTP status code of responses reporting errors with this
+// code, 500 for unknown codes
+func (c Code) Status() int {
+	if status, ok := statuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// coded is implemented by errors of this package
+type coded interface {
+	error
+	ErrorCode() Code
+}
+
+// CodeOf returns the code of the first error in err's chain that has one.
+// Temporary errors from other packages are Unavailable, other errors are
+// Internal. CodeOf(nil) is "".
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+
+	var c coded
+	if As(err, &c) {
+		return c.ErrorCode()
+	}
+
+	var t interface{ Temporary() bool }
+	if As(err, &t) && t.Temporary() {
+		return Unavailable
+	}
+
+	return Internal
+}
+
+// Status returns the HTTP status code for reporting err, see Code.Status
+func Status(err error) int { return CodeOf(err).Status() }
+
+// Error is an error with a code. Path identifies what it's about, e.g. the
+// name of a file or a field. Message describes the error without its cause,
+// and is suitable for clients, unlike Err.
+type Error struct {
+	Code    Code
+	Path    string
+	Message string
+	Err     error
+}
+
+// New returns an error with a code and message
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Wrap returns an error with a code and message, caused by err
+func Wrap(err error, code Code, message string) *Error {
+	return &Error{Code: code, Message: message, Err: err}
+}
+
+func (e *Error) Error() string {
+	var parts []string
+	if e.Path != "" {
+		parts = append(parts, e.Path)
+	}
+	if e.Message != "" {
+		parts = append(parts, e.Message)
+	} else if e.Err == nil {
+		parts = append(parts, string(e.Code))
+	}
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+	return strings.Join(parts, ": ")
+}
+
+func (e *Error) ErrorCode() Code      { return e.Code }
+func (e *Error) Unwrap() error        { return e.Err }
+func (e *Error) Is(target error) bool { return target == e.Code }
+func (e *Error) Temporary() bool      { return e.Code == Unavailable }
+
+// Field is an invalid input value, identified by the name of the input and a
+// stable machine readable code. Its reason is suitable for clients, unlike
+// the errors it may replace (e.g. from strconv or time.Parse).
+type Field struct {
+	Name   string
+	Code   string
+	Reason string
+}
+
+func (e Field) Error() string      { return e.Name + ": " + e.Reason }
+func (Field) ErrorCode() Code      { return Invalid }
+func (Field) Is(target error) bool { return target == Invalid }
+
 type Temporary string
 
-func (s Temporary) Error() string { return string(s) }
-func (Temporary) Temporary() bool { return true }
+func (s Temporary) Error() string      { return string(s) }
+func (Temporary) Temporary() bool      { return true }
+func (Temporary) ErrorCode() Code      { return Unavailable }
+func (Temporary) Is(target error) bool { return target == Unavailable }
+
+// Overloaded is a temporary error for operations rejected due to load, with an
+// estimate of when they may succeed
+type Overloaded struct {
+	Reason string
+	Delay  time.Duration
+}
 
+func (e Overloaded) Error() string             { return e.Reason }
+func (Overloaded) Temporary() bool             { return true }
+func (e Overloaded) RetryAfter() time.Duration { return e.Delay }
+func (Overloaded) ErrorCode() Code             { return Unavailable }
+func (Overloaded) Is(target error) bool        { return target == Unavailable }
+
+// Errors is a list of errors, see Collect. It matches Is and As if any of its
+// elements does, and its code is shared by all of its elements, or Internal
+// if they differ.
 type Errors []error
 
-func (err Errors) Error() string { return fmt.Sprintf("%+v", []error(err)) } // TODO improve formatting?
+func (errs Errors) Error() string {
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	}
 
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(len(errs)))
+	b.WriteString(" errors: ")
+	for i, err := range errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Format prints each error on its own line with %+v
+func (errs Errors) Format(s fmt.State, verb rune) {
+	if verb == 'v' && s.Flag('+') {
+		fmt.Fprintf(s, "%d errors:", len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(s, "\n\t%+v", err)
+		}
+		return
+	}
+	fmt.Fprint(s, errs.Error())
+}
+
+func (errs Errors) ErrorCode() Code {
+	var code Code
+	for _, err := range errs {
+		if c := CodeOf(err); code == "" {
+			code = c
+		} else if c != code {
+			return Internal
+		}
+	}
+	return code
+}
+
+func (errs Errors) Is(target error) bool {
+	for _, err := range errs {
+		if Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (errs Errors) As(target interface{}) bool {
+	for _, err := range errs {
+		if As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Collect accumulates errors into an Errors, ignoring nil errors. A single
+// error is not wrapped.
 func Collect(accum *error, new error) {
 	if new == nil {
 		return
@@ -24,3 +243,14 @@ func Collect(accum *error, new error) {
 		*accum = Errors{*accum, new}
 	}
 }
+
+// Is reports whether any error in err's chain matches target, see the
+// standard library's errors.Is
+func Is(err, target error) bool { return stderrors.Is(err, target) }
+
+// As finds the first error in err's chain that matches target, see the
+// standard library's errors.As
+func As(err error, target interface{}) bool { return stderrors.As(err, target) }
+
+// Unwrap returns the cause of err, if any
+func Unwrap(err error) error { return stderrors.Unwrap(err) }
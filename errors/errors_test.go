@@ -0,0 +1,88 @@
+package errors
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodeOf(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		code   Code
+		status int
+	}{
+		{nil, "", http.StatusInternalServerError},
+		{io.EOF, Internal, http.StatusInternalServerError},
+		{New(NotFound, "no such thing"), NotFound, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", New(Forbidden, "")), Forbidden, http.StatusForbidden},
+		{Field{"price", "required", "must be a positive number"}, Invalid, http.StatusBadRequest},
+		{Temporary("shutting down"), Unavailable, http.StatusServiceUnavailable},
+		{Overloaded{"busy", time.Second}, Unavailable, http.StatusServiceUnavailable},
+		{Errors{Field{Name: "a"}, Field{Name: "b"}}, Invalid, http.StatusBadRequest},
+		{Errors{Field{Name: "a"}, io.EOF}, Internal, http.StatusInternalServerError},
+		{Wrap(io.EOF, Corrupt, "truncated"), Corrupt, http.StatusInternalServerError},
+	} {
+		if code := CodeOf(c.err); code != c.code {
+			t.Errorf("code of %v should be %q, not %q", c.err, c.code, code)
+		}
+		if c.err != nil && Status(c.err) != c.status {
+			t.Errorf("status of %v should be %d, not %d", c.err, c.status, Status(c.err))
+		}
+	}
+}
+
+func TestIsAs(t *testing.T) {
+	err := fmt.Errorf("context: %w", Wrap(io.EOF, Unavailable, "degraded"))
+
+	if !Is(err, io.EOF) {
+		t.Error("cause should be matched through wrapping")
+	}
+	if !Is(err, Unavailable) || Is(err, NotFound) {
+		t.Error("code should be matched by Is")
+	}
+
+	var e *Error
+	if !As(err, &e) || e.Message != "degraded" {
+		t.Error("Error should be found by As", e)
+	}
+
+	var errs error
+	Collect(&errs, io.ErrUnexpectedEOF)
+	Collect(&errs, Overloaded{"busy", time.Second})
+
+	var o Overloaded
+	if !As(errs, &o) || o.Delay != time.Second {
+		t.Error("elements of Errors should be found by As", errs)
+	}
+	if !Is(errs, io.ErrUnexpectedEOF) || Is(errs, io.EOF) {
+		t.Error("elements of Errors should be matched by Is", errs)
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	err := &Error{Code: Corrupt, Path: "fileSeq", Message: "invalid value 0", Err: io.EOF}
+	if s := err.Error(); s != "fileSeq: invalid value 0: EOF" {
+		t.Error("unexpected message", s)
+	}
+	if s := New(NotFound, "").Error(); s != "not_found" {
+		t.Error("code should be used without a message", s)
+	}
+
+	var errs error
+	Collect(&errs, Field{"from", "invalid_timestamp", "must be an RFC 3339 timestamp"})
+	if s := errs.Error(); s != "from: must be an RFC 3339 timestamp" {
+		t.Error("single error should not be decorated", s)
+	}
+
+	Collect(&errs, Field{"to", "invalid_timestamp", "must be an RFC 3339 timestamp"})
+	if s := errs.Error(); s != "2 errors: from: must be an RFC 3339 timestamp; to: must be an RFC 3339 timestamp" {
+		t.Error("unexpected message", s)
+	}
+	if s := fmt.Sprintf("%+v", errs); strings.Count(s, "\n\t") != 2 {
+		t.Error("each error should be on its own line", s)
+	}
+}
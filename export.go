@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nothingmuch/repricer/storage"
+)
+
+// exportPrices writes the price history of a data directory to stdout or a
+// file. Like fsck it's safe to run against the data directory of a live
+// server.
+func exportPrices(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer export [data directory]")
+		flags.PrintDefaults()
+	}
+	productId := flags.String("product", "", "only export the records of this `productId`")
+	output := flags.String("o", "", "write to this `file` instead of stdout")
+	_ = flags.Parse(args)
+
+	dir, ok := dataDir(flags)
+	if !ok {
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+
+	buf := bufio.NewWriter(w)
+	n, err := storage.Export(storage.OS(dir), buf, *productId)
+	if err == nil {
+		err = buf.Flush()
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d records\n", n)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export aborted:", err)
+		return 1
+	}
+
+	return 0
+}
+
+// importPrices writes price history in the format written by export into a
+// new data directory
+func importPrices(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer import [data directory]")
+		flags.PrintDefaults()
+	}
+	input := flags.String("i", "", "read from this `file` instead of stdin")
+	opts := storage.Options{}
+	flags.IntVar(&opts.MaxRecordsPerFile, "max-records-per-file", storage.DefaultMaxRecordsPerFile, "maximum number of records in a results file")
+	flags.DurationVar(&opts.FlushInterval, "flush-interval", storage.DefaultFlushInterval, "maximum time between the first and last records of a results file")
+	_ = flags.Parse(args)
+
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		// the directory is created if it doesn't exist
+		opts.Path = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := storage.Import(context.Background(), opts, bufio.NewReader(r))
+
+	fmt.Fprintf(os.Stderr, "imported %d records\n", n)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import aborted:", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nothingmuch/repricer/storage"
+)
+
+// fsck performs a read only consistency check of a data directory, which is
+// safe to run against the data directory of a live server
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer fsck [data directory]")
+		flags.PrintDefaults()
+	}
+	verbose := flags.Bool("v", false, "list pending files")
+	repair := flags.Bool("repair", false, "make the repairs that are made on startup, which requires that the server is not running")
+	_ = flags.Parse(args)
+
+	dir, ok := dataDir(flags)
+	if !ok {
+		return 2
+	}
+
+	if *repair {
+		report, err := storage.Repair(context.Background(), dir)
+		for _, repair := range report.Repairs {
+			fmt.Println("repaired", repair)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "repair aborted:", err)
+			return 2
+		}
+	}
+
+	report, err := storage.Check(storage.OS(dir))
+
+	for _, violation := range report.Violations {
+		fmt.Println(violation)
+	}
+	if *verbose {
+		for _, pending := range report.Pending {
+			fmt.Println("pending", pending)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "checked %d files, %d records: %d violations, %d pending\n", report.Files, report.Records, len(report.Violations), len(report.Pending))
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check aborted:", err)
+		return 2
+	}
+
+	if len(report.Violations) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// dataDir returns the optional data directory argument of a command, which
+// defaults to the working directory. If it's invalid the error is reported,
+// and false is returned.
+func dataDir(flags *flag.FlagSet) (string, bool) {
+	dir := "."
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		flags.Usage()
+		return "", false
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return "", false
+	}
+
+	return dir, true
+}
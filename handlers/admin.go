@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+)
+
+// ReloadResult describes the settings that changed when the configuration was
+// reloaded, by name
+type ReloadResult struct {
+	Applied         []string `json:"applied"`         // changes in effect
+	RestartRequired []string `json:"restartRequired"` // changes which take effect after a restart
+}
+
+// Reloader reloads the configuration of the service, and returns an error
+// without applying any of it if it's invalid
+type Reloader func() (ReloadResult, error)
+
+// Backuper writes a tar archive of the data directory to w. It must not write
+// anything before it can be sure that it will succeed, since errors can't be
+// reported once the response has started.
+type Backuper func(ctx context.Context, w io.Writer) error
+
+// AdminOptions configures the administrative endpoints. Zero values are
+// replaced by defaults.
+type AdminOptions struct {
+	// BackupTimeout bounds how long a backup requested with
+	// `GET /admin/backup` may wait for the data directory's files to be
+	// finalized, by default DefaultBackupTimeout
+	BackupTimeout time.Duration
+}
+
+// DefaultBackupTimeout is the default of AdminOptions.BackupTimeout
+const DefaultBackupTimeout = time.Minute
+
+func (o AdminOptions) withDefaults() AdminOptions {
+	if o.BackupTimeout <= 0 {
+		o.BackupTimeout = DefaultBackupTimeout
+	}
+	return o
+}
+
+// Admin constructs a handler for administrative endpoints. They are not
+// authenticated, so the handler must only be served on a local address:
+//   - `POST /admin/reload` reloads the configuration, and responds with the
+//     ReloadResult.
+//   - `GET /admin/backup` responds with a gzip compressed tar archive of the
+//     data directory, or an uncompressed one with `?format=tar`.
+func Admin(reload Reloader, backup Backuper, opts AdminOptions) http.Handler {
+	opts = opts.withDefaults()
+
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/reload", reloadHandler(reload))
+	adminMux.Handle("/admin/backup", backupHandler{backup, opts.BackupTimeout})
+	return adminMux
+}
+
+type reloadHandler Reloader
+
+func (reload reloadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, req, errors.New(errors.InvalidMethod, "method must be POST"))
+		return
+	}
+
+	result, err := reload()
+	if err != nil {
+		// the configuration is provided by the operator, who needs to
+		// know what's wrong with it
+		logging.FromContext(req.Context()).Error("reloading configuration", "error", err)
+		writeError(w, req, errors.Wrap(err, errors.Invalid, "invalid configuration: "+err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	if err := e.Encode(result); err != nil {
+		logging.FromContext(req.Context()).Error("encoding response", "error", err)
+	}
+}
+
+type backupHandler struct {
+	backup  Backuper
+	timeout time.Duration
+}
+
+func (h backupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, req, errors.New(errors.InvalidMethod, "method must be GET"))
+		return
+	}
+
+	contentType, extension := "application/gzip", ".tar.gz"
+	switch req.URL.Query().Get("format") {
+	case "", "tar.gz":
+	case "tar":
+		contentType, extension = "application/x-tar", ".tar"
+	default:
+		writeError(w, req, errors.Field{Name: "format", Code: fieldInvalidValue, Reason: "must be tar or tar.gz"})
+		return
+	}
+
+	// the response only starts once the archive is being written, so that
+	// errors while waiting for the files to be finalized can be reported
+	out := &lazyResponse{ResponseWriter: w, start: func() {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="repricer-`+time.Now().UTC().Format("20060102T150405Z")+extension+`"`)
+		w.WriteHeader(http.StatusOK)
+	}}
+
+	var archive io.Writer = out
+	var zw *gzip.Writer
+	if extension == ".tar.gz" {
+		zw = gzip.NewWriter(out)
+		archive = zw
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+	defer cancel()
+
+	err := h.backup(ctx, archive)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+
+	if err != nil {
+		logging.FromContext(req.Context()).Error("writing backup", "error", err)
+		if !out.started {
+			writeError(w, req, err)
+			return
+		}
+
+		// abort the response so that the client can't mistake a
+		// truncated archive for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// lazyResponse calls start before the first write to the response
+type lazyResponse struct {
+	http.ResponseWriter
+	start   func()
+	started bool
+}
+
+func (w *lazyResponse) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.start()
+	}
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+)
+
+// APIKeyHeader carries the API key of a client
+const APIKeyHeader = "X-API-Key"
+
+// authenticate rejects requests without a valid API key granting scope, if
+// Options.Keys is set. The authenticated principal is made available to the
+// handler and the model through the request context.
+func authenticate(scope auth.Scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		keys := current(req).Keys
+		if keys == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		log := logging.FromContext(req.Context())
+
+		principal, ok := keys.Authenticate(req.Header.Get(APIKeyHeader))
+		if !ok {
+			log.Warn("authentication failed", "key_provided", req.Header.Get(APIKeyHeader) != "")
+			w.Header().Set("WWW-Authenticate", `APIKey header="`+APIKeyHeader+`"`)
+			writeError(w, req, errors.New(errors.Unauthorized, "missing or invalid "+APIKeyHeader+" header"))
+			return
+		}
+
+		log = log.With("principal", principal.Name)
+		if !principal.Allowed(scope) {
+			log.Warn("permission denied", "scope", scope)
+			writeError(w, req, errors.New(errors.Forbidden, "API key lacks the "+string(scope)+" scope"))
+			return
+		}
+
+		ctx := auth.NewContext(req.Context(), principal)
+		ctx = logging.NewContext(ctx, log)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// allowedProduct checks whether the authenticated principal, if any, may
+// access a product, responding with 403 if not
+func allowedProduct(w http.ResponseWriter, req *http.Request, productId string) bool {
+	principal := auth.FromContext(req.Context())
+	if principal == nil || principal.AllowedProduct(productId) {
+		return true
+	}
+
+	logging.FromContext(req.Context()).Warn("permission denied", "product_id", productId)
+	writeError(w, req, errors.New(errors.Forbidden, "productId not allowed for this API key"))
+	return false
+}
@@ -3,6 +3,12 @@ package handlers
 import (
 	"net/http"
 	"regexp"
+	"time"
+
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
 )
 
 // Model is a combined interface for the storage model needed to construct the combined service
@@ -10,43 +16,167 @@ type Model interface {
 	PriceUpdater
 	PriceReader
 	PriceLogRetriever
-
-	// TODO liveness/readyness checking interface
 }
 
 // this is regexp is used as to anchor per-handler path patterns, ugly hack but will do for now
 var basePath = regexp.MustCompile(`^/?(?:api/)?`)
 
-func API(m Model) http.Handler {
+// Options configures the behavior of the API
+type Options struct {
+	// DurableWrites makes the reprice endpoint wait for new prices to be
+	// stored before responding, if the model supports it. Otherwise this
+	// is only done for requests with a `Prefer: durable` header.
+	DurableWrites bool
+
+	// QueueWait is how long a reprice request may wait for the model's write
+	// queue to drain before being rejected, which absorbs short bursts. It
+	// doesn't apply to durable writes, which are rejected immediately.
+	QueueWait time.Duration
+
+	// Metrics, if not nil, is used to register request metrics
+	Metrics *metrics.Registry
+
+	// Signatures, if not nil, are required for the bodies of reprice requests
+	Signatures *auth.SignatureVerifier
+
+	// Keys, if not nil, are required for all requests, which are only
+	// allowed the endpoints and products permitted by their key
+	Keys *auth.Keys
+
+	// RateLimits are the budgets of each client by endpoint name (reprice,
+	// product or query). Endpoints without a limit are not rate limited.
+	RateLimits map[string]RateLimit
+
+	// AuthFailureLimit is the budget of failed authentication attempts of
+	// each client IP, shared by all endpoints. It's always enforced, by
+	// default with DefaultAuthFailureRate and DefaultAuthFailureBurst.
+	AuthFailureLimit RateLimit
+
+	// Logger, if not nil, is used to log requests and errors. The model
+	// receives a logger with the request ID through the request context.
+	Logger *logging.Logger
+
+	// MaxInFlight bounds the number of concurrent requests to each of the
+	// product and query endpoints, by default DefaultMaxInFlight
+	MaxInFlight int
+
+	// PageSize is the number of entries returned by the query endpoint if
+	// the request doesn't specify one, by default DefaultPageSize
+	PageSize int
+}
+
+// defaults of Options
+const (
+	DefaultMaxInFlight      = 50
+	DefaultPageSize         = 25
+	DefaultAuthFailureRate  = 0.2 // one attempt every 5 seconds
+	DefaultAuthFailureBurst = 10
+)
+
+func (o Options) withDefaults() Options {
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = DefaultMaxInFlight
+	}
+	if o.PageSize <= 0 {
+		o.PageSize = DefaultPageSize
+	}
+	if !(o.AuthFailureLimit.Rate > 0) {
+		o.AuthFailureLimit.Rate = DefaultAuthFailureRate
+	}
+	if o.AuthFailureLimit.Burst < 1 {
+		o.AuthFailureLimit.Burst = DefaultAuthFailureBurst
+	}
+	return o
+}
+
+// API constructs the handler of all endpoints. All options except for Metrics
+// and Logger can be replaced with Handler.Reload.
+func API(m Model, opts Options) *Handler {
 	// instead of using some router/framework, we just just use a ServeMux,
 	// but individual handlers still use regexes defined in their respective
 	// files to strictly validate the path
 	apiMux := http.NewServeMux()
 
-	apiMux.Handle("/api/reprice", Reprice(m))
-	apiMux.Handle("/api/product/", throttle(Product(m), 50))
-	apiMux.Handle("/api/query", throttle(Query(m), 50))
+	repricer := reprice{
+		PriceUpdater: m,
+		rejected:     newCounter(opts.Metrics, "repricer_reprice_rejected_total", "Number of reprice requests rejected because the storage model could not accept writes.", nil),
+		invalid:      newCounter(opts.Metrics, "repricer_reprice_invalid_total", "Number of reprice requests rejected due to invalid input.", nil),
+		badSigs:      newSignatureRejectionCounts(opts.Metrics),
+	}
+
+	// clients are authenticated before rate limiting, so that they're
+	// limited by identity, but failed attempts are limited by IP address
+	// across all endpoints
+	authFailures := newAuthFailureLimit(opts.Metrics)
+	limit := func(endpoint string, scope auth.Scope, h http.Handler) http.Handler {
+		return authFailures.wrap(authenticate(scope, rateLimit(opts.Metrics, endpoint, h)))
+	}
+
+	apiMux.Handle("/api/reprice", instrument(opts.Metrics, "reprice", limit("reprice", auth.ScopeReprice, repricer)))
+	apiMux.Handle("/api/product/", instrument(opts.Metrics, "product", limit("product", auth.ScopeProduct, throttle(opts.Metrics, "product", Product(m)))))
+	apiMux.Handle("/api/query", instrument(opts.Metrics, "query", limit("query", auth.ScopeQuery, throttle(opts.Metrics, "query", Query(m)))))
+
+	h := &Handler{handler: accessLog(opts.Logger, apiMux)}
+	h.Reload(opts)
+	return h
+}
+
+// newCounter constructs and registers a counter, or returns nil if the
+// registry is nil
+func newCounter(r *metrics.Registry, name, help string, labels metrics.Labels) *metrics.Counter {
+	if r == nil {
+		return nil
+	}
 
-	return apiMux
+	c := metrics.NewCounter()
+	r.Register(name, help, labels, c)
+	return c
 }
 
-func throttle(h http.Handler, inFlight int) http.Handler {
-	return semaphoreHandler{h, make(chan struct{}, inFlight)}
+// instrument measures the latency of requests to an endpoint
+func instrument(r *metrics.Registry, endpoint string, h http.Handler) http.Handler {
+	if r == nil {
+		return h
+	}
+
+	latency := metrics.NewHistogram(metrics.DefaultBuckets)
+	r.Register("repricer_http_request_duration_seconds", "Latency of API requests.", metrics.Labels{"endpoint": endpoint}, latency)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer latency.ObserveSince(time.Now())
+		h.ServeHTTP(w, req)
+	})
+}
+
+// throttle bounds the number of concurrent requests to an endpoint, see
+// Options.MaxInFlight
+func throttle(r *metrics.Registry, endpoint string, h http.Handler) http.Handler {
+	return semaphoreHandler{
+		Handler:  h,
+		endpoint: endpoint,
+		rejected: newCounter(r, "repricer_http_throttled_total", "Number of API requests rejected due to too many concurrent requests.", metrics.Labels{"endpoint": endpoint}),
+	}
 }
 
 type semaphoreHandler struct {
 	http.Handler
-	semaphore chan struct{}
+	endpoint string
+	rejected *metrics.Counter
 }
 
 func (s semaphoreHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the request releases the semaphore it acquired, even if it has been
+	// replaced by a reload in the meantime
+	semaphore := current(req).semaphores[s.endpoint]
+
 	select {
-	case s.semaphore <- struct{}{}:
-		defer func() { <-s.semaphore }()
+	case semaphore <- struct{}{}:
+		defer func() { <-semaphore }()
 		s.Handler.ServeHTTP(w, req)
 	default:
-		code := http.StatusServiceUnavailable
-		http.Error(w, http.StatusText(code), code)
+		s.rejected.Inc()
+		logging.FromContext(req.Context()).Warn("too many concurrent requests", "capacity", cap(semaphore))
+		writeError(w, req, errors.New(errors.Unavailable, "too many concurrent requests, retry later"))
 		return
 	}
 }
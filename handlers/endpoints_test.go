@@ -14,8 +14,11 @@ TODO:
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -23,7 +26,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/errors"
 	"github.com/nothingmuch/repricer/handlers"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
 func TestRepriceEndpoint(t *testing.T) {
@@ -44,8 +52,565 @@ func TestRepriceEndpoint(t *testing.T) {
 	}
 }
 
+func TestRepriceEndpointUnavailable(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+
+	w := httptest.NewRecorder()
+	handlers.Reprice(failingModel{errors.Temporary("persistent storage degraded")}).ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Error("response code should be 503 when the model rejects writes")
+	}
+
+	req = httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+
+	w = httptest.NewRecorder()
+	handlers.Reprice(failingModel{errors.Overloaded{Reason: "write capacity exceeded", Delay: 2500 * time.Millisecond}}).ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusServiceUnavailable || w.Result().Header.Get("Retry-After") != "3" {
+		t.Error("response should have a Retry-After header when the model is overloaded", w.Result().StatusCode, w.Result().Header)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	type problem struct {
+		Status        int
+		Code          string
+		Detail        string
+		InvalidParams []struct{ Name, Code, Reason string }
+	}
+
+	do := func(h http.Handler, method, url, body string) (p problem, contentType string) {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if err := json.NewDecoder(w.Result().Body).Decode(&p); err != nil {
+			t.Error("response body should be a problem", err)
+		}
+		if p.Status != w.Result().StatusCode {
+			t.Error("problem status should match response", p.Status, w.Result().StatusCode)
+		}
+		return p, w.Result().Header.Get("Content-Type")
+	}
+
+	params := func(p problem) string {
+		var s []string
+		for _, param := range p.InvalidParams {
+			s = append(s, param.Name+"="+param.Code)
+		}
+		return strings.Join(s, ",")
+	}
+
+	q := handlers.Query(simpleMap{t, map[string]entry{}})
+	p, contentType := do(q, "GET", "http://example.com/api/query?pagesize=x&pageNumber=1&from=yesterday&to=2019-01-01T00:00:00Z&include=everything", "")
+	if contentType != "application/problem+json" {
+		t.Error("content type should be application/problem+json, not", contentType)
+	}
+	if p.Status != http.StatusBadRequest || p.Code != "invalid_request" {
+		t.Error("invalid query should be a bad request", p)
+	}
+	if s := params(p); s != "pagesize=invalid_integer,from=invalid_timestamp,include=invalid_value" {
+		t.Error("every invalid parameter should be reported", s)
+	}
+	for _, param := range p.InvalidParams {
+		if strings.Contains(param.Reason, "parsing") {
+			t.Error("reason should not expose parse errors", param.Reason)
+		}
+	}
+
+	r := handlers.Reprice(noopModel{})
+	for _, c := range []struct{ body, code, params string }{
+		{``, "malformed_body", ""},
+		{`{"productId":`, "malformed_body", ""},
+		{`{"productId":"foo","price":1,"extra":1}`, "invalid_request", "extra=unknown_field"},
+		{`{"productId":1,"price":1}`, "invalid_request", "productId=invalid_type"},
+		{`{}`, "invalid_request", "productId=required,price=required"},
+		{`{"productId":"foo","price":0}`, "invalid_request", "price=invalid_value"},
+	} {
+		p, _ := do(r, "POST", "http://example.com/api/reprice", c.body)
+		if p.Status != http.StatusBadRequest || p.Code != c.code || params(p) != c.params {
+			t.Error("unexpected problem for", c.body, p)
+		}
+	}
+
+	for _, c := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errors.Temporary("shutting down"), http.StatusServiceUnavailable, "unavailable"},
+		{errors.Overloaded{Reason: "write capacity exceeded"}, http.StatusServiceUnavailable, "unavailable"},
+		{fmt.Errorf("disk on fire"), http.StatusInternalServerError, "internal_error"},
+	} {
+		p, _ := do(handlers.Reprice(failingModel{c.err}), "POST", "http://example.com/api/reprice", `{"productId":"foo","price":1}`)
+		if p.Status != c.status || p.Code != c.code || strings.Contains(p.Detail, c.err.Error()) {
+			t.Error("unexpected problem for", c.err, p)
+		}
+	}
+
+	if p, _ := do(r, "GET", "http://example.com/api/reprice", ""); p.Code != "invalid_method" {
+		t.Error("unexpected problem for GET", p)
+	}
+	if p, _ := do(handlers.Product(simpleMap{t, map[string]entry{}}), "GET", "http://example.com/api/product/foo/price", ""); p.Status != http.StatusNotFound || p.Code != "not_found" {
+		t.Error("unexpected problem for missing product", p)
+	}
+}
+
+func TestRepriceEndpointDurable(t *testing.T) {
+	m := durableModel{simpleMap{t, make(map[string]entry)}, time.Unix(1500000000, 0)}
+
+	for _, h := range []http.Handler{
+		handlers.Reprice(m), // preference must be requested
+		handlers.API(m, handlers.Options{DurableWrites: true}),
+	} {
+		req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+		req.Header.Set("Prefer", "respond-async, durable")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		resp := w.Result()
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Error("response code should be 201")
+		}
+
+		if resp.Header.Get("Preference-Applied") != "durable" {
+			t.Error("Preference-Applied header should be set")
+		}
+
+		var rec struct {
+			ProductId     string
+			Price         json.Number
+			PreviousPrice json.Number
+			Timestamp     float64
+		}
+		if err := json.Unmarshal(body, &rec); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.ProductId != "foo" || rec.Price != "3.50" || rec.PreviousPrice != "2.50" || rec.Timestamp != 1500000000 {
+			t.Error("unexpected response body", string(body))
+		}
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+
+	w := httptest.NewRecorder()
+	handlers.Reprice(m).ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusAccepted {
+		t.Error("response code should be 202 without a durable preference")
+	}
+}
+
+func TestProductEndpointDurable(t *testing.T) {
+	m := durableModel{simpleMap{t, make(map[string]entry)}, time.Unix(1500000000, 0)}
+	_ = m.UpdatePrice(context.Background(), "foo", "3.50")
+
+	get := func(query string) (int, string) {
+		req := httptest.NewRequest("GET", "http://example.com/api/product/foo/price"+query, nil)
+		w := httptest.NewRecorder()
+		handlers.Product(m).ServeHTTP(w, req)
+
+		var body struct{ Price json.Number }
+		_ = json.NewDecoder(w.Result().Body).Decode(&body)
+		return w.Result().StatusCode, body.Price.String()
+	}
+
+	if code, price := get(""); code != http.StatusOK || price != "3.50" {
+		t.Error("default reads should not wait for durability", code, price)
+	}
+
+	if code, price := get("?consistency=durable"); code != http.StatusOK || price != "2.50" {
+		t.Error("durable reads should only return durable prices", code, price)
+	}
+
+	if code, _ := get("?consistency=strong"); code != http.StatusBadRequest {
+		t.Error("response code should be 400 for unknown consistency levels")
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/api/product/foo/price?consistency=durable", nil)
+	w := httptest.NewRecorder()
+	handlers.Product(m.simpleMap).ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusNotImplemented {
+		t.Error("response code should be 501 if the model doesn't support durable reads")
+	}
+}
+
+func TestBackplane(t *testing.T) {
+	status := healthStatus{IsAlive: true}
+	h := handlers.Backplane(func() handlers.HealthStatus { return status })
+
+	probe := func(path string) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+path, nil))
+
+		var body healthStatus
+		if err := json.NewDecoder(w.Result().Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		return w.Result().StatusCode, body
+	}
+
+	if code, body := probe("/healthz/alive"); code != http.StatusOK || body != status {
+		t.Error("liveness probe should succeed with status in body", code, body)
+	}
+
+	if code, _ := probe("/healthz/ready"); code != http.StatusServiceUnavailable {
+		t.Error("readiness probe should fail", code)
+	}
+
+	status.IsReady = true
+	if code, _ := probe("/healthz/ready"); code != http.StatusOK {
+		t.Error("readiness probe should succeed", code)
+	}
+}
+
+func TestAPIMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := handlers.API(failingModel{errors.Temporary("persistent storage degraded")}, handlers.Options{Metrics: registry})
+
+	req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var buf bytes.Buffer
+	_, _ = registry.WriteTo(&buf)
+
+	for _, sample := range []string{
+		`repricer_http_request_duration_seconds_count{endpoint="reprice"} 1`,
+		`repricer_reprice_rejected_total 1`,
+	} {
+		if !strings.Contains(buf.String(), sample+"\n") {
+			t.Error("metrics should contain", sample)
+		}
+	}
+}
+
+func TestAPILogging(t *testing.T) {
+	var buf bytes.Buffer
+	m := &requestIDModel{failingModel: failingModel{errors.Temporary("persistent storage degraded")}}
+	h := handlers.API(m, handlers.Options{Logger: logging.New(&buf, logging.Info)})
+
+	req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+	req.Header.Set(handlers.RequestIDHeader, "abc123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	id := w.Result().Header.Get(handlers.RequestIDHeader)
+	if id == "" || id == "abc123" {
+		t.Error("request ID should be generated by the server and returned in the response", id)
+	}
+
+	if len(m.requestIDs) != 1 || m.requestIDs[0] != id {
+		t.Error("request ID should be propagated to the model", m.requestIDs)
+	}
+
+	var entries []map[string]interface{}
+	for d := json.NewDecoder(&buf); d.More(); {
+		var entry map[string]interface{}
+		if err := d.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatal("should have logged the rejection and the request", entries)
+	}
+
+	if entries[0]["level"] != "warn" || entries[0]["request_id"] != id || entries[0]["client_request_id"] != "abc123" {
+		t.Error("rejection should be logged as a warning with the request IDs", entries[0])
+	}
+
+	if entries[1]["msg"] != "request" || entries[1]["status"] != float64(http.StatusServiceUnavailable) || entries[1]["request_id"] != id {
+		t.Error("request should be logged with its status and ID", entries[1])
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api/product/foo/price", nil))
+
+	if other := w.Result().Header.Get(handlers.RequestIDHeader); other == "" || other == id {
+		t.Error("every request should have a new request ID", other)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	m := simpleMap{t, make(map[string]entry)}
+	_ = m.UpdatePrice(context.Background(), "foo", "3.50")
+	h := handlers.API(m, handlers.Options{RateLimits: map[string]handlers.RateLimit{"product": {Rate: 0.5, Burst: 2}}})
+
+	get := func(apiKey string) *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com/api/product/foo/price", nil)
+		if apiKey != "" {
+			req.Header.Set(handlers.APIKeyHeader, apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		resp := get("")
+		if resp.StatusCode != http.StatusOK {
+			t.Error("requests within the burst should succeed", i, resp.StatusCode)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != remaining {
+			t.Error("rate limit headers should describe the remaining budget", resp.Header)
+		}
+	}
+
+	resp := get("")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Error("response code should be 429 once the budget is exhausted", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "2" || resp.Header.Get("RateLimit-Reset") != "4" {
+		t.Error("Retry-After and RateLimit-Reset should reflect the refill rate", resp.Header)
+	}
+
+	if resp := get("secret"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Error("unauthenticated clients should not evade their limit by sending an API key", resp.StatusCode)
+	}
+
+	other := httptest.NewRequest("GET", "http://example.com/api/product/foo/price", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, other)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Error("clients with another IP should have their own budget", w.Result().StatusCode)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Result().StatusCode != http.StatusAccepted || w.Result().Header.Get("RateLimit-Limit") != "" {
+		t.Error("endpoints without a limit should not be rate limited", w.Result().StatusCode)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	keys, err := auth.ParseKeys([]byte(`[
+		{"name": "pricing", "keyHash": "` + auth.HashKey("pricing-key") + `", "scopes": ["reprice", "product"], "productPrefixes": ["acme-"]},
+		{"name": "reporting", "keyHash": "` + auth.HashKey("reporting-key") + `", "scopes": ["product", "query"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &principalModel{simpleMap: simpleMap{t, make(map[string]entry)}}
+	h := handlers.API(m, handlers.Options{Keys: keys})
+
+	do := func(method, path, body, key string) int {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(handlers.APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	for _, c := range []struct {
+		method, path, body, key string
+		code                    int
+	}{
+		{"POST", "/api/reprice", `{"productId":"acme-1","price":3.50}`, "", http.StatusUnauthorized},
+		{"POST", "/api/reprice", `{"productId":"acme-1","price":3.50}`, "wrong", http.StatusUnauthorized},
+		{"POST", "/api/reprice", `{"productId":"acme-1","price":3.50}`, "reporting-key", http.StatusForbidden},
+		{"POST", "/api/reprice", `{"productId":"other-1","price":3.50}`, "pricing-key", http.StatusForbidden},
+		{"POST", "/api/reprice", `{"productId":"acme-1","price":3.50}`, "pricing-key", http.StatusAccepted},
+		{"GET", "/api/product/acme-1/price", "", "pricing-key", http.StatusOK},
+		{"GET", "/api/product/acme-1/price", "", "reporting-key", http.StatusOK},
+		{"GET", "/api/query", "", "pricing-key", http.StatusForbidden},
+		{"GET", "/api/query", "", "reporting-key", http.StatusOK},
+	} {
+		if code := do(c.method, c.path, c.body, c.key); code != c.code {
+			t.Error(c.method, c.path, c.body, "with key", c.key, "should respond with", c.code, "not", code)
+		}
+	}
+
+	if len(m.principals) != 1 || m.principals[0] != "pricing" {
+		t.Error("authenticated principal should be passed to the model", m.principals)
+	}
+}
+
+func TestAuthFailureLimit(t *testing.T) {
+	keys, err := auth.ParseKeys([]byte(`[{"name": "reporting", "keyHash": "` + auth.HashKey("reporting-key") + `", "scopes": ["product"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := simpleMap{t, make(map[string]entry)}
+	_ = m.UpdatePrice(context.Background(), "foo", "3.50")
+	h := handlers.API(m, handlers.Options{Keys: keys, AuthFailureLimit: handlers.RateLimit{Rate: 0.5, Burst: 2}})
+
+	get := func(h http.Handler, path, key, remoteAddr string) int {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set(handlers.APIKeyHeader, key)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	// the budget is shared by all endpoints
+	for i, path := range []string{"/api/product/foo/price", "/api/query?productId=foo"} {
+		if code := get(h, path, "guess", "192.0.2.1:1234"); code != http.StatusUnauthorized {
+			t.Error("failed attempts within the budget should be rejected as unauthorized", i, code)
+		}
+	}
+	if code := get(h, "/api/product/foo/price", "reporting-key", "192.0.2.1:1234"); code != http.StatusTooManyRequests {
+		t.Error("a client IP should be limited once it has exhausted its budget of failed attempts", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := get(h, "/api/product/foo/price", "reporting-key", "192.0.2.2:1234"); code != http.StatusOK {
+			t.Error("successful attempts should not count against the client IP", i, code)
+		}
+	}
+
+	// failed attempts are limited without any configuration
+	h = handlers.API(m, handlers.Options{Keys: keys})
+	for i := 0; i < handlers.DefaultAuthFailureBurst; i++ {
+		if code := get(h, "/api/product/foo/price", "guess", "192.0.2.1:1234"); code != http.StatusUnauthorized {
+			t.Error("failed attempts within the default budget should be rejected as unauthorized", i, code)
+		}
+	}
+	if code := get(h, "/api/product/foo/price", "guess", "192.0.2.1:1234"); code != http.StatusTooManyRequests {
+		t.Error("failed attempts should be limited by default", code)
+	}
+}
+
+func TestRepriceSignatures(t *testing.T) {
+	var logs bytes.Buffer
+	registry := metrics.NewRegistry()
+	secret := []byte("crawler secret")
+	h := handlers.API(simpleMap{t, make(map[string]entry)}, handlers.Options{
+		Signatures: auth.NewSignatureVerifier(map[string][]byte{"crawlers": secret}, time.Minute),
+		Metrics:    registry,
+		Logger:     logging.New(&logs, logging.Info),
+	})
+
+	post := func(body, signature string, now time.Time, nonce string) int {
+		req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader(body))
+		if signature != "" {
+			req.Header.Set(handlers.SignatureTimestampHeader, fmt.Sprint(now.Unix()))
+			req.Header.Set(handlers.SignatureNonceHeader, nonce)
+			req.Header.Set(handlers.SignatureHeader, signature)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	now := time.Now()
+	body := `{"productId":"foo","price":3.50}`
+
+	if code := post(body, auth.Sign(secret, now, "1", []byte(body)), now, "1"); code != http.StatusAccepted {
+		t.Error("signed request should be accepted", code)
+	}
+
+	if code := post(body, auth.Sign(secret, now, "1", []byte(body)), now, "1"); code != http.StatusUnauthorized {
+		t.Error("replayed request should be rejected", code)
+	}
+
+	if code := post(body, "", now, ""); code != http.StatusUnauthorized {
+		t.Error("unsigned request should be rejected", code)
+	}
+
+	invalid := `{"productId":"","price":3.50}`
+	if code := post(invalid, auth.Sign(secret, now, "2", []byte(invalid)), now, "2"); code != http.StatusBadRequest {
+		t.Error("signed request should still be validated", code)
+	}
+
+	var buf bytes.Buffer
+	_, _ = registry.WriteTo(&buf)
+	for _, sample := range []string{
+		`repricer_reprice_signature_rejected_total{reason="replayed"} 1`,
+		`repricer_reprice_signature_rejected_total{reason="missing"} 1`,
+		`repricer_reprice_invalid_total 1`,
+	} {
+		if !strings.Contains(buf.String(), sample+"\n") {
+			t.Error("metrics should contain", sample)
+		}
+	}
+
+	if n := strings.Count(logs.String(), `"msg":"signature rejected"`); n != 2 {
+		t.Error("signature rejections should be logged distinctly", n, logs.String())
+	}
+	if n := strings.Count(logs.String(), `"msg":"invalid reprice request"`); n != 1 {
+		t.Error("validation errors should be logged distinctly", n, logs.String())
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	m := &provenanceModel{simpleMap: simpleMap{t, make(map[string]entry)}}
+	h := handlers.API(m, handlers.Options{})
+
+	req := httptest.NewRequest("POST", "http://example.com/api/reprice", strings.NewReader((`{"productId":"foo","price":3.50}`)))
+	req.Header.Set("User-Agent", "crawler/1.0")
+	req.Header.Set(handlers.SourceHeader, "crawler-farm")
+	req.Header.Set(handlers.RequestIDHeader, "abc123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	requestID := w.Result().Header.Get(handlers.RequestIDHeader)
+
+	query := func(params string) (int, []map[string]interface{}) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api/query?productId=foo"+params, nil))
+
+		var body []map[string]interface{}
+		_ = json.NewDecoder(w.Result().Body).Decode(&body)
+		return w.Result().StatusCode, body
+	}
+
+	code, body := query("&include=provenance")
+	if code != http.StatusOK || len(body) != 1 {
+		t.Fatal("query should return the update", code, body)
+	}
+
+	expected := map[string]interface{}{
+		"clientIp":        "192.0.2.1",
+		"userAgent":       "crawler/1.0",
+		"requestId":       requestID,
+		"clientRequestId": "abc123",
+		"source":          "crawler-farm",
+	}
+	if p, _ := body[0]["provenance"].(map[string]interface{}); fmt.Sprint(p) != fmt.Sprint(expected) {
+		t.Error("provenance should be included when requested", body[0])
+	}
+
+	if _, body := query(""); len(body) != 1 || body[0]["provenance"] != nil {
+		t.Error("provenance should be omitted by default", body)
+	}
+
+	if code, _ := query("&include=secrets"); code != http.StatusBadRequest {
+		t.Error("response code should be 400 for unknown includes", code)
+	}
+
+	keys, err := auth.ParseKeys([]byte(`[
+		{"name": "reporting", "keyHash": "` + auth.HashKey("reporting-key") + `", "scopes": ["query"]},
+		{"name": "audit", "keyHash": "` + auth.HashKey("audit-key") + `", "scopes": ["query", "provenance"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Reload(handlers.Options{Keys: keys})
+
+	for key, expected := range map[string]int{"reporting-key": http.StatusForbidden, "audit-key": http.StatusOK} {
+		req := httptest.NewRequest("GET", "http://example.com/api/query?productId=foo&include=provenance", nil)
+		req.Header.Set(handlers.APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Result().StatusCode != expected {
+			t.Error("provenance should require the provenance scope", key, w.Result().StatusCode)
+		}
+	}
+}
+
 func TestStatefulness(t *testing.T) {
-	h := handlers.API(simpleMap{t, make(map[string]entry)})
+	h := handlers.API(simpleMap{t, make(map[string]entry)}, handlers.Options{})
 
 	// all returned times must be later than this
 	t0 := float64(time.Now().UnixNano()) * (float64(time.Nanosecond) / float64(time.Second))
@@ -172,7 +737,92 @@ func TestStatefulness(t *testing.T) {
 
 type noopModel struct{}
 
-func (noopModel) UpdatePrice(string, json.Number) error { return nil }
+func (noopModel) UpdatePrice(context.Context, string, json.Number) error { return nil }
+
+type failingModel struct{ err error }
+
+type principalModel struct {
+	simpleMap
+	principals []string
+}
+
+func (m *principalModel) UpdatePrice(ctx context.Context, productId string, price json.Number) error {
+	if p := auth.FromContext(ctx); p != nil {
+		m.principals = append(m.principals, p.Name)
+	}
+	return m.simpleMap.UpdatePrice(ctx, productId, price)
+}
+
+// provenanceModel records the provenance of updates, and returns it in the
+// price log
+type provenanceModel struct {
+	simpleMap
+	provenance []provenance.Provenance
+}
+
+func (m *provenanceModel) UpdatePrice(ctx context.Context, productId string, price json.Number) error {
+	m.provenance = append(m.provenance, provenance.FromContext(ctx))
+	return m.simpleMap.UpdatePrice(ctx, productId, price)
+}
+
+func (m *provenanceModel) PriceLog(_ context.Context, productId string, _, _ time.Time, _ int64, _ int) (ret []struct {
+	ProductId  string
+	Price      json.Number
+	Timestamp  time.Time
+	Provenance provenance.Provenance
+}, _ error) {
+	for _, p := range m.provenance {
+		ent := m.data[productId]
+		ret = append(ret, struct {
+			ProductId  string
+			Price      json.Number
+			Timestamp  time.Time
+			Provenance provenance.Provenance
+		}{productId, ent.Price, ent.Time, p})
+	}
+	return
+}
+
+type requestIDModel struct {
+	failingModel
+	requestIDs []string
+}
+
+func (m *requestIDModel) UpdatePrice(ctx context.Context, productId string, price json.Number) error {
+	m.requestIDs = append(m.requestIDs, logging.RequestID(ctx))
+	return m.failingModel.UpdatePrice(ctx, productId, price)
+}
+
+func (m failingModel) UpdatePrice(context.Context, string, json.Number) error { return m.err }
+func (m failingModel) LastPrice(context.Context, string) (json.Number, time.Time, error) {
+	return "", time.Time{}, m.err
+}
+func (m failingModel) PriceLog(_ context.Context, _ string, _, _ time.Time, _ int64, _ int) ([]struct {
+	ProductId  string
+	Price      json.Number
+	Timestamp  time.Time
+	Provenance provenance.Provenance
+}, error) {
+	return nil, m.err
+}
+
+type durableModel struct {
+	simpleMap
+	timestamp time.Time
+}
+
+func (m durableModel) UpdatePriceDurable(context.Context, string, json.Number) (json.Number, time.Time, error) {
+	return "2.50", m.timestamp, nil
+}
+
+func (m durableModel) LastDurablePrice(context.Context, string) (json.Number, time.Time, error) {
+	return "2.50", m.timestamp, nil
+}
+
+type healthStatus struct{ IsAlive, IsReady bool }
+
+func (s healthStatus) Alive() bool { return s.IsAlive }
+func (s healthStatus) Ready() bool { return s.IsReady }
 
 // simple in memory model to check state updates
 type entry struct {
@@ -184,21 +834,135 @@ type simpleMap struct {
 	data map[string]entry
 }
 
-func (m simpleMap) UpdatePrice(productId string, price json.Number) error {
+func (m simpleMap) UpdatePrice(_ context.Context, productId string, price json.Number) error {
 	m.data[productId] = entry{price, time.Now()}
 	m.Log("->state", productId, m.data[productId])
 	return nil
 }
-func (m simpleMap) LastPrice(productId string) (json.Number, time.Time, error) {
+func (m simpleMap) LastPrice(_ context.Context, productId string) (json.Number, time.Time, error) {
 	ent := m.data[productId]
 	m.Log("<-state", productId, ent)
 	return ent.Price, ent.Time, nil
 }
 
-func (m simpleMap) PriceLog(_ string, _, _ time.Time, _ int64, _ int) ([]struct {
-	ProductId string
-	Price     json.Number
-	Timestamp time.Time
+func (m simpleMap) PriceLog(_ context.Context, _ string, _, _ time.Time, _ int64, _ int) ([]struct {
+	ProductId  string
+	Price      json.Number
+	Timestamp  time.Time
+	Provenance provenance.Provenance
 }, error) {
 	return nil, nil // FIXME implement or remove as part of priceModel bikeshedding refactor
 }
+
+func TestReload(t *testing.T) {
+	m := simpleMap{t, make(map[string]entry)}
+	_ = m.UpdatePrice(context.Background(), "foo", "3.50")
+	h := handlers.API(m, handlers.Options{})
+
+	get := func() *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com/api/product/foo/price", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	if resp := get(); resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Limit") != "" {
+		t.Fatal("requests should not be rate limited before reloading", resp.StatusCode)
+	}
+
+	h.Reload(handlers.Options{RateLimits: map[string]handlers.RateLimit{"product": {Rate: 0.5, Burst: 1}}})
+	if resp := get(); resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Limit") != "1" {
+		t.Error("reloaded rate limits should apply to subsequent requests", resp.Header)
+	}
+	if resp := get(); resp.StatusCode != http.StatusTooManyRequests {
+		t.Error("reloaded rate limits should be enforced", resp.StatusCode)
+	}
+
+	keys, err := auth.ParseKeys([]byte(`[{"name": "reader", "keyHash": "` + auth.HashKey("reader") + `", "scopes": ["product"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Reload(handlers.Options{Keys: keys})
+	if resp := get(); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("reloaded keys should be required", resp.StatusCode)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	var err error
+	h := handlers.Admin(func() (handlers.ReloadResult, error) {
+		return handlers.ReloadResult{Applied: []string{"pageSize"}, RestartRequired: []string{"addr"}}, err
+	}, nil, handlers.AdminOptions{})
+
+	reload := func(method string) *http.Response {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "http://example.com/admin/reload", nil))
+		return w.Result()
+	}
+
+	if resp := reload("GET"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("reload should require POST", resp.StatusCode)
+	}
+
+	resp := reload("POST")
+	var result handlers.ReloadResult
+	if e := json.NewDecoder(resp.Body).Decode(&result); e != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.StatusCode, e)
+	}
+	if len(result.Applied) != 1 || result.Applied[0] != "pageSize" || len(result.RestartRequired) != 1 || result.RestartRequired[0] != "addr" {
+		t.Error("response should describe the reloaded settings", result)
+	}
+
+	err = fmt.Errorf("config.json: unexpected EOF")
+	resp = reload("POST")
+	var p struct{ Code, Detail string }
+	_ = json.NewDecoder(resp.Body).Decode(&p)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(p.Detail, "unexpected EOF") {
+		t.Error("invalid configurations should be reported", resp.StatusCode, p)
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	var err error
+	h := handlers.Admin(nil, func(ctx context.Context, w io.Writer) error {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Second {
+			t.Error("backup should be bounded by BackupTimeout", deadline, ok)
+		}
+		if err != nil {
+			return err
+		}
+		_, _ = w.Write([]byte("archive"))
+		return nil
+	}, handlers.AdminOptions{BackupTimeout: time.Second})
+
+	backup := func(query string) *http.Response {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/admin/backup"+query, nil))
+		return w.Result()
+	}
+
+	resp := backup("")
+	zr, zerr := gzip.NewReader(resp.Body)
+	if zerr != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/gzip" {
+		t.Fatal("backup should be compressed by default", resp.StatusCode, resp.Header, zerr)
+	}
+	if body, _ := ioutil.ReadAll(zr); string(body) != "archive" {
+		t.Error("response should contain the archive", string(body))
+	}
+
+	resp = backup("?format=tar")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "archive" || resp.Header.Get("Content-Type") != "application/x-tar" || !strings.Contains(resp.Header.Get("Content-Disposition"), ".tar\"") {
+		t.Error("backup should not be compressed with format=tar", resp.Header, string(body))
+	}
+
+	if resp := backup("?format=zip"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("unknown formats should be rejected", resp.StatusCode)
+	}
+
+	// errors before the archive is written are reported
+	err = errors.Temporary("waiting for files to be finalized")
+	if resp := backup(""); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Content-Type") != "application/problem+json" {
+		t.Error("errors should be reported as problems", resp.StatusCode, resp.Header)
+	}
+}
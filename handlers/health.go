@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nothingmuch/repricer/logging"
+)
+
+// HealthStatus is a snapshot of a model's health, which is serialized as JSON
+// in probe responses
+type HealthStatus interface {
+	// Alive reports whether the process can make progress, if not it
+	// should be restarted
+	Alive() bool
+	// Ready reports whether requests can be served
+	Ready() bool
+}
+
+// HealthCheck returns the current health of the service
+type HealthCheck func() HealthStatus
+
+// Backplane constructs a handler for liveness and readiness probes, which
+// respond with 200 or 503 depending on the result of the check
+func Backplane(check HealthCheck) http.Handler {
+	backplaneMux := http.NewServeMux()
+
+	backplaneMux.Handle("/healthz/alive", probe{check, HealthStatus.Alive})
+	backplaneMux.Handle("/healthz/ready", probe{check, HealthStatus.Ready})
+
+	return backplaneMux
+}
+
+type probe struct {
+	check HealthCheck
+	ok    func(HealthStatus) bool
+}
+
+func (p probe) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status := p.check()
+
+	code := http.StatusOK
+	if !p.ok(status) {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	if err := e.Encode(status); err != nil {
+		logging.FromContext(req.Context()).Error("encoding response", "error", err)
+	}
+}
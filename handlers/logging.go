@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/nothingmuch/repricer/logging"
+)
+
+// RequestIDHeader carries the ID used to correlate log entries with a
+// request. The ID is always generated by the server, and returned in the
+// response. A valid ID provided by the client is logged next to it, but since
+// it can't be trusted it's never used in its place.
+const RequestIDHeader = "X-Request-Id"
+
+const maxRequestIDLength = 128
+
+// accessLog assigns a request ID to every request, and makes a logger with
+// that ID available to handlers and the model through the request context.
+// Once the response has been written, it's logged.
+func accessLog(log *logging.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := newRequestID()
+		w.Header().Set(RequestIDHeader, id)
+
+		reqLog := log.With("request_id", id)
+		if clientID := req.Header.Get(RequestIDHeader); validRequestID(clientID) {
+			reqLog = reqLog.With("client_request_id", clientID)
+		}
+		ctx := logging.NewContext(logging.WithRequestID(req.Context(), id), reqLog)
+
+		rw := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rw, req.WithContext(ctx))
+
+		reqLog.Info("request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"remote_addr", req.RemoteAddr,
+			"status", rw.status(),
+			"bytes", rw.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// validRequestID rejects IDs which are empty, too long, or which contain
+// characters that don't belong in a header or a log entry
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // only fails if the OS has no entropy source, in which case the ID is still usable
+	return hex.EncodeToString(b[:])
+}
+
+// responseRecorder captures the status code and length of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *responseRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
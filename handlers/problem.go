@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+)
+
+// problems caused by signatures are reported with this prefix followed by the
+// auth.SignatureError, instead of errors.Unauthorized
+const codeSignaturePrefix = "signature_"
+
+// codes of invalid parameters, see errors.Field
+const (
+	fieldRequired      = "required"
+	fieldInvalidValue  = "invalid_value"
+	fieldInvalidType   = "invalid_type"
+	fieldInvalidNumber = "invalid_integer"
+	fieldInvalidTime   = "invalid_timestamp"
+	fieldUnknown       = "unknown_field"
+)
+
+const problemContentType = "application/problem+json"
+
+// problem is an RFC 7807 problem details object. The type member is omitted,
+// which is equivalent to about:blank, so the title is the HTTP status text.
+type problem struct {
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Code          string         `json:"code"`
+	RequestID     string         `json:"requestId,omitempty"`
+	InvalidParams []invalidParam `json:"invalidParams,omitempty"`
+}
+
+type invalidParam struct {
+	Name   string `json:"name"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// writeProblem responds with a problem details body. If err is not nil it's
+// flattened into the invalid parameters, see invalidParams.
+func writeProblem(w http.ResponseWriter, req *http.Request, status int, code, detail string, err error) {
+	body := problem{
+		Title:         http.StatusText(status),
+		Status:        status,
+		Detail:        detail,
+		Code:          code,
+		RequestID:     logging.RequestID(req.Context()),
+		InvalidParams: invalidParams(err),
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	if err := e.Encode(body); err != nil {
+		logging.FromContext(req.Context()).Error("encoding response", "error", err)
+	}
+}
+
+// writeError responds with a problem describing err. Its status and code are
+// decided by the code of err, see errors.CodeOf. Only the message of the
+// outermost errors.Error is used as the detail, since other messages are not
+// meant for clients.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	code := errors.CodeOf(err)
+
+	var detail string
+	var e *errors.Error
+	if errors.As(err, &e) {
+		detail = e.Message
+	}
+
+	writeProblem(w, req, code.Status(), string(code), detail, err)
+}
+
+// invalidParams lists every errors.Field in an error, which may be an
+// errors.Errors or wrapped in an errors.Error. Other errors are not exposed
+// to clients, since they may reveal implementation details.
+func invalidParams(err error) []invalidParam {
+	var params []invalidParam
+
+	switch err := err.(type) {
+	case *errors.Error:
+		params = invalidParams(err.Err)
+	case errors.Errors:
+		for _, err := range err {
+			params = append(params, invalidParams(err)...)
+		}
+	case errors.Field:
+		params = append(params, invalidParam{Name: err.Name, Code: err.Code, Reason: err.Reason})
+	}
+
+	return params
+}
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"regexp"
 	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
 )
 
 // Product constructs a new product price endpoint with the given storage model
@@ -14,29 +18,48 @@ func Product(m PriceReader) http.Handler { return product{m} }
 type PriceReader interface {
 	// LastPrice fetches the latest price. If missing all data should be
 	// zero valued (non nil errors signify actual failure)
-	LastPrice(productId string) (json.Number, time.Time, error)
+	LastPrice(ctx context.Context, productId string) (json.Number, time.Time, error)
+}
+
+// DurablePriceReader is an optional interface for models which can provide
+// read-your-writes consistency
+type DurablePriceReader interface {
+	// LastDurablePrice fetches the latest price that has been durably
+	// stored, i.e. that is guaranteed to reflect any completed durable
+	// write
+	LastDurablePrice(ctx context.Context, productId string) (json.Number, time.Time, error)
 }
 
 type product struct{ PriceReader }
 
+// supported values of the `consistency` query parameter
+const (
+	consistencyDefault = ""        // fast, possibly reflecting unsynced writes
+	consistencyDurable = "durable" // only reflects synced writes
+)
+
 var productPath = regexp.MustCompile(basePath.String() + `product/(.+)/price$`) // this should be constrained to ensure clean upgrade path for API namespace
 
 func (s product) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// TODO rate limiting
 	submatches := productPath.FindStringSubmatch(req.URL.Path)
 	if len(submatches) != 2 {
-		http.Error(w, "not found", http.StatusNotFound)
+		writeError(w, req, errors.New(errors.NotFound, ""))
 		return
 	}
 
 	if req.Method != "GET" {
-		http.Error(w, "method must be GET", http.StatusBadRequest)
+		writeError(w, req, errors.New(errors.InvalidMethod, "method must be GET"))
 		return
 	}
 
 	productId := submatches[1]
 	if len(productId) < 1 {
-		http.Error(w, "invalid or missing productId (must be non empty string)", http.StatusBadRequest)
+		writeError(w, req, errors.Wrap(errors.Field{Name: "productId", Code: fieldRequired, Reason: "must be a non empty string"}, errors.Invalid, "invalid productId"))
+		return
+	}
+
+	if !allowedProduct(w, req, productId) {
 		return
 	}
 
@@ -46,16 +69,30 @@ func (s product) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		Timestamp epochTime   `json:"timestamp"`
 	}
 
-	// TODO read from model, logging
-	price, t, err := s.LastPrice(productId)
+	lastPrice := s.LastPrice
+	switch req.URL.Query().Get("consistency") {
+	case consistencyDefault:
+	case consistencyDurable:
+		durable, ok := s.PriceReader.(DurablePriceReader)
+		if !ok {
+			writeError(w, req, errors.New(errors.Unsupported, "durable consistency not supported"))
+			return
+		}
+		lastPrice = durable.LastDurablePrice
+	default:
+		writeError(w, req, errors.Wrap(errors.Field{Name: "consistency", Code: fieldInvalidValue, Reason: "must be durable or omitted"}, errors.Invalid, "invalid query parameters"))
+		return
+	}
+
+	price, t, err := lastPrice(req.Context(), productId)
 	if err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		// TODO log err
+		logging.FromContext(req.Context()).Error("reading price", "product_id", productId, "error", err)
+		writeError(w, req, err)
 		return
 	}
 
 	if price == json.Number("") {
-		http.Error(w, "productId not found", http.StatusNotFound)
+		writeError(w, req, errors.New(errors.NotFound, "productId not found"))
 		return
 	}
 
@@ -68,7 +105,9 @@ func (s product) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	e := json.NewEncoder(w)
 	e.SetIndent("", "\t") // specification example has literal tabs in it, but this is also silly
-	_ = e.Encode(body)    // TODO log error if any, only likely to be IO errors
+	if err := e.Encode(body); err != nil {
+		logging.FromContext(req.Context()).Error("encoding response", "error", err)
+	}
 }
 
 // serialized in JSON as fractional unix epoch time
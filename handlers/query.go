@@ -1,13 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nothingmuch/repricer/auth"
 	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
 // Query constructs a new query price endpoint with the given storage model
@@ -16,15 +21,17 @@ func Query(m PriceLogRetriever) http.Handler { return query{m} }
 // PriceLogRetriever defines an interface for fetching historical price data
 type PriceLogRetriever interface {
 	PriceLog(
+		ctx context.Context,
 		productId string,
 		startTime, endTime time.Time,
 		offset int64, limit int,
 	) (
 		[]struct {
 			// TODO make Entry/Record types public?
-			ProductId string
-			Price     json.Number
-			Timestamp time.Time
+			ProductId  string
+			Price      json.Number
+			Timestamp  time.Time
+			Provenance provenance.Provenance
 		}, error)
 }
 
@@ -35,12 +42,12 @@ var queryPath = regexp.MustCompile(basePath.String() + `query`)
 func (s query) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// TODO rate limiting
 	if !queryPath.MatchString(req.URL.Path) {
-		http.Error(w, "not found", http.StatusNotFound)
+		writeError(w, req, errors.New(errors.NotFound, ""))
 		return
 	}
 
 	if req.Method != "GET" {
-		http.Error(w, "method must be GET", http.StatusBadRequest)
+		writeError(w, req, errors.New(errors.InvalidMethod, "method must be GET"))
 		return
 	}
 
@@ -57,29 +64,57 @@ func (s query) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		productId = v[0]
 	}
 	if v, exists := params["pagesize"]; exists && len(v) == 1 { // note inconsistent capitalization
-		pageSize, err = strconv.Atoi(v[0])
-		errors.Collect(&inputErrors, err)
+		if pageSize, err = strconv.Atoi(v[0]); err != nil {
+			errors.Collect(&inputErrors, errors.Field{Name: "pagesize", Code: fieldInvalidNumber, Reason: "must be an integer"})
+		}
 	}
 	if v, exists := params["pageNumber"]; exists && len(v) == 1 {
-		pageNumber, err = strconv.Atoi(v[0])
-		errors.Collect(&inputErrors, err)
+		if pageNumber, err = strconv.Atoi(v[0]); err != nil {
+			errors.Collect(&inputErrors, errors.Field{Name: "pageNumber", Code: fieldInvalidNumber, Reason: "must be an integer"})
+		}
 	}
 	if v, exists := params["from"]; exists && len(v) == 1 {
-		startTime, err = time.Parse(time.RFC3339, v[0])
-		errors.Collect(&inputErrors, err)
+		if startTime, err = time.Parse(time.RFC3339, v[0]); err != nil {
+			errors.Collect(&inputErrors, errors.Field{Name: "from", Code: fieldInvalidTime, Reason: "must be an RFC 3339 timestamp"})
+		}
 	}
 	if v, exists := params["to"]; exists && len(v) == 1 {
-		endTime, err = time.Parse(time.RFC3339, v[0])
-		errors.Collect(&inputErrors, err)
+		if endTime, err = time.Parse(time.RFC3339, v[0]); err != nil {
+			errors.Collect(&inputErrors, errors.Field{Name: "to", Code: fieldInvalidTime, Reason: "must be an RFC 3339 timestamp"})
+		}
+	}
+	var includeProvenance bool
+	if v, exists := params["include"]; exists && len(v) == 1 {
+		for _, field := range strings.Split(v[0], ",") {
+			switch field {
+			case "provenance":
+				includeProvenance = true
+			default:
+				errors.Collect(&inputErrors, errors.Field{Name: "include", Code: fieldInvalidValue, Reason: "must be provenance"})
+			}
+		}
 	}
 	if inputErrors != nil {
-		http.Error(w, inputErrors.Error(), http.StatusBadRequest) // FIXME sanitize errors
+		writeError(w, req, errors.Wrap(inputErrors, errors.Invalid, "invalid query parameters"))
 		return
+	}
 
+	// keys restricted to some products can't query all of them at once
+	if principal := auth.FromContext(req.Context()); principal != nil && principal.Restricted() && productId == "" {
+		writeError(w, req, errors.New(errors.Forbidden, "productId is required for this API key"))
+		return
+	}
+	if !allowedProduct(w, req, productId) {
+		return
+	}
+	if principal := auth.FromContext(req.Context()); principal != nil && includeProvenance && !principal.Allowed(auth.ScopeProvenance) {
+		logging.FromContext(req.Context()).Warn("permission denied", "scope", auth.ScopeProvenance)
+		writeError(w, req, errors.New(errors.Forbidden, "API key lacks the "+string(auth.ScopeProvenance)+" scope"))
+		return
 	}
 
 	if pageSize == 0 {
-		pageSize = 25 // FIXME arbitrary
+		pageSize = current(req).PageSize
 	}
 
 	// convert pagination information to more convenient representation for data
@@ -89,23 +124,27 @@ func (s query) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	limit := pageSize
 
-	entries, err := s.PriceLog(productId, startTime, endTime, offset, limit)
+	entries, err := s.PriceLog(req.Context(), productId, startTime, endTime, offset, limit)
 	if err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		// TODO log err
+		logging.FromContext(req.Context()).Error("reading price log", "product_id", productId, "error", err)
+		writeError(w, req, err)
 		return
 	}
 
 	body := make([]struct {
-		ProductId string      `json:"productId"`
-		Price     json.Number `json:"price"`
-		Timestamp epochTime   `json:"timestamp"`
+		ProductId  string                 `json:"productId"`
+		Price      json.Number            `json:"price"`
+		Timestamp  epochTime              `json:"timestamp"`
+		Provenance *provenance.Provenance `json:"provenance,omitempty"`
 	}, len(entries))
 
 	for i, ent := range entries {
 		body[i].ProductId = ent.ProductId
 		body[i].Price = ent.Price
 		body[i].Timestamp = epochTime(ent.Timestamp)
+		if includeProvenance {
+			body[i].Provenance = &entries[i].Provenance
+		}
 	}
 
 	// json content type
@@ -113,5 +152,7 @@ func (s query) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	e := json.NewEncoder(w)
 	e.SetIndent("", "\t") // specification example has literal tabs in it, but this is also silly
-	_ = e.Encode(body)    // TODO log error if any, only likely to be IO errors
+	if err := e.Encode(body); err != nil {
+		logging.FromContext(req.Context()).Error("encoding response", "error", err)
+	}
 }
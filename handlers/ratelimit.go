@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
+)
+
+// RateLimit is a token bucket budget for each client of an endpoint. A zero
+// Rate disables rate limiting.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // requests per second, on average
+	Burst int     `json:"burst"` // capacity of the bucket, i.e. requests allowed at once
+}
+
+// maxClients bounds the number of tracked clients. Beyond it, the bucket of
+// the least recently seen client is discarded, which resets its budget, but
+// such a client has usually refilled its bucket anyway.
+const maxClients = 10000
+
+// rateLimit limits each client of an endpoint to the endpoint's budget in
+// Options.RateLimits
+func rateLimit(r *metrics.Registry, endpoint string, h http.Handler) http.Handler {
+	return &rateLimiter{
+		Handler:  h,
+		endpoint: endpoint,
+		buckets:  newClientBuckets(),
+		limited:  newCounter(r, "repricer_http_rate_limited_total", "Number of API requests rejected because the client exceeded its rate limit.", metrics.Labels{"endpoint": endpoint}),
+	}
+}
+
+type rateLimiter struct {
+	http.Handler
+	endpoint string
+	buckets  *clientBuckets
+	limited  *metrics.Counter
+}
+
+func (l *rateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	limit := current(req).RateLimits[l.endpoint]
+	if limit.Rate <= 0 {
+		l.Handler.ServeHTTP(w, req)
+		return
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	ok, remaining, wait, reset := l.buckets.take(clientKey(req), limit, time.Now())
+
+	// advertise the policy as per draft-ietf-httpapi-ratelimit-headers
+	window := float64(limit.Burst) / limit.Rate
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, seconds(time.Duration(window*float64(time.Second)))))
+
+	if !ok {
+		l.limited.Inc()
+		logging.FromContext(req.Context()).Warn("rate limit exceeded", "retry_after", wait)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(wait)))
+		writeError(w, req, errors.New(errors.RateLimited, "rate limit exceeded, retry later"))
+		return
+	}
+
+	l.Handler.ServeHTTP(w, req)
+}
+
+// authFailureLimit limits the failed authentication attempts of each client
+// IP to Options.AuthFailureLimit, so that API keys can't be guessed as fast as
+// the server responds. The budget is shared by all endpoints it wraps, so
+// spreading guesses across them doesn't help. Once an IP has exhausted its
+// budget, its requests are rejected before being authenticated until the
+// budget refills. Successful requests are limited by rateLimit instead.
+type authFailureLimit struct {
+	buckets *clientBuckets
+	limited *metrics.Counter
+}
+
+func newAuthFailureLimit(r *metrics.Registry) authFailureLimit {
+	return authFailureLimit{
+		buckets: newClientBuckets(),
+		limited: newCounter(r, "repricer_http_auth_failures_limited_total", "Number of API requests rejected because the client IP made too many failed authentication attempts.", nil),
+	}
+}
+
+// wrap limits the authentication failures of h, in the same budget as every
+// other handler wrapped by l
+func (l authFailureLimit) wrap(h http.Handler) http.Handler {
+	return authFailureLimiter{h, l}
+}
+
+type authFailureLimiter struct {
+	http.Handler
+	authFailureLimit
+}
+
+// ServeHTTP rejects the requests of clients which are out of tokens, and only
+// takes a token if authentication failed
+func (l authFailureLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	limit := current(req).AuthFailureLimit
+	client := "ip:" + clientIP(req)
+
+	if ok, wait := l.buckets.available(client, limit, time.Now()); !ok {
+		l.limited.Inc()
+		logging.FromContext(req.Context()).Warn("too many failed authentication attempts", "retry_after", wait)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(wait)))
+		writeError(w, req, errors.New(errors.RateLimited, "too many failed authentication attempts, retry later"))
+		return
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	l.Handler.ServeHTTP(rec, req)
+	if rec.status() == http.StatusUnauthorized {
+		l.buckets.take(client, limit, time.Now())
+	}
+}
+
+// clientBuckets tracks the token buckets of recently seen clients
+type clientBuckets struct {
+	sync.Mutex
+	buckets map[string]*list.Element // of recent, by client
+	recent  *list.List               // of *tokenBucket, least recently used first
+}
+
+func newClientBuckets() *clientBuckets {
+	return &clientBuckets{buckets: make(map[string]*list.Element), recent: list.New()}
+}
+
+// tokenBucket holds the tokens available to a client at a point in time
+type tokenBucket struct {
+	client string
+	tokens float64
+	time   time.Time
+}
+
+// take removes a token from a client's bucket if one is available. It
+// returns the number of remaining tokens, how long until a token will be
+// available, and how long until the bucket is full again. A bucket which is
+// fuller than a reduced limit allows is drained on its next refill.
+func (c *clientBuckets) take(client string, limit RateLimit, now time.Time) (ok bool, remaining int, wait, reset time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	b := c.bucket(client, limit, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		wait = limit.duration(1 - b.tokens)
+	}
+
+	return ok, int(b.tokens), wait, limit.duration(float64(limit.Burst) - b.tokens)
+}
+
+// available reports whether a token is available in a client's bucket without
+// taking it, and if not how long until one will be
+func (c *clientBuckets) available(client string, limit RateLimit, now time.Time) (ok bool, wait time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if b := c.bucket(client, limit, now); b.tokens < 1 {
+		return false, limit.duration(1 - b.tokens)
+	}
+	return true, 0
+}
+
+// bucket returns a client's refilled bucket, tracking a new client if
+// necessary. It must be called with the lock held.
+func (c *clientBuckets) bucket(client string, limit RateLimit, now time.Time) *tokenBucket {
+	var b *tokenBucket
+	if e, exists := c.buckets[client]; exists {
+		c.recent.MoveToBack(e)
+		b = e.Value.(*tokenBucket)
+	} else {
+		if c.recent.Len() >= maxClients {
+			oldest := c.recent.Remove(c.recent.Front()).(*tokenBucket)
+			delete(c.buckets, oldest.client)
+		}
+		b = &tokenBucket{client: client, tokens: float64(limit.Burst), time: now}
+		c.buckets[client] = c.recent.PushBack(b)
+	}
+
+	b.refill(limit, now)
+	return b
+}
+
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.time); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * limit.Rate
+		b.time = now
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens)
+}
+
+// duration returns how long it takes to accumulate tokens
+func (limit RateLimit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / limit.Rate * float64(time.Second))
+}
+
+// seconds rounds up, so that clients which wait that long will not be limited
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientKey identifies the client of a request by its principal, once it has
+// been authenticated, or otherwise by its IP address, since anything else in
+// an unauthenticated request can be varied to evade the limit
+func clientKey(req *http.Request) string {
+	if principal := auth.FromContext(req.Context()); principal != nil {
+		return "principal:" + principal.Name
+	}
+
+	return "ip:" + clientIP(req)
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
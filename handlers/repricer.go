@@ -1,73 +1,154 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
 // Reprice constructs a new reprice endpoint handler with the given storage model
-func Reprice(m PriceUpdater) http.Handler { return reprice{m} }
+func Reprice(m PriceUpdater) http.Handler { return reprice{PriceUpdater: m} }
 
 // PriceUpdater defines an interface for writing new price data to storage
 type PriceUpdater interface {
 	// UpdatePrice sets the latest price for a productId
-	UpdatePrice(productId string, price json.Number) error
+	UpdatePrice(ctx context.Context, productId string, price json.Number) error
+}
+
+// DurablePriceUpdater is an optional interface for models which can wait for
+// price data to be durably stored
+type DurablePriceUpdater interface {
+	// UpdatePriceDurable sets the latest price for a productId, and returns
+	// the finalized record's previous price and timestamp once it's stored
+	UpdatePriceDurable(ctx context.Context, productId string, price json.Number) (previousPrice json.Number, timestamp time.Time, err error)
 }
 
-type reprice struct{ PriceUpdater }
+type reprice struct {
+	PriceUpdater
+	rejected *metrics.Counter         // counts updates rejected with a temporary error
+	invalid  *metrics.Counter         // counts requests failing validation
+	badSigs  signatureRejectionCounts // counts requests with rejected signatures, by reason
+}
+
+// headers of signed requests, see auth.SignatureVerifier
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+)
+
+// SourceHeader declares the system a price update originated from, which is
+// recorded with it
+const SourceHeader = "X-Source"
+
+// bounds the size of client provided provenance fields stored with records
+const maxProvenanceFieldLength = 256
+
+// bodies of reprice requests are tiny, this only bounds the memory used to
+// verify signatures
+const maxRepriceBodySize = 64 << 10
+
+type signatureRejectionCounts map[auth.SignatureError]*metrics.Counter
+
+func newSignatureRejectionCounts(r *metrics.Registry) signatureRejectionCounts {
+	counts := make(signatureRejectionCounts)
+	for _, reason := range []auth.SignatureError{auth.SignatureMissing, auth.SignatureMalformed, auth.SignatureExpired, auth.SignatureInvalid, auth.SignatureReplayed} {
+		counts[reason] = newCounter(r, "repricer_reprice_signature_rejected_total", "Number of reprice requests rejected due to their signature.", metrics.Labels{"reason": string(reason)})
+	}
+	return counts
+}
 
 var repricePath = regexp.MustCompile(basePath.String() + `reprice$`)
 
 func (s reprice) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if !repricePath.MatchString(req.URL.Path) {
-		http.Error(w, "not found", http.StatusNotFound)
+		writeError(w, req, errors.New(errors.NotFound, ""))
 		return
 	}
 
 	if req.Method != "POST" {
-		http.Error(w, "method must be POST", http.StatusBadRequest)
+		writeError(w, req, errors.New(errors.InvalidMethod, "method must be POST"))
+		return
+	}
+
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRepriceBodySize))
+	if err != nil {
+		s.invalidRequest(w, req, errors.Wrap(err, errors.Malformed, "request body must be at most 64KiB"))
 		return
 	}
 
-	// TODO access control
+	opts := current(req)
+
+	if opts.Signatures != nil && !s.verifySignature(w, req, opts.Signatures, raw) {
+		return
+	}
 
 	var body struct {
 		ProductId string      `json:"productId"`
 		Price     json.Number `json:"price"`
 	}
 
-	d := json.NewDecoder(req.Body)
+	d := json.NewDecoder(bytes.NewReader(raw))
 	d.DisallowUnknownFields()
-	err := d.Decode(&body)
-	if err != nil {
-		// TODO sanitize errors (in particular EOF)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	err = d.Decode(&body)
+	if field, ok := decodeError(err).(errors.Field); ok {
+		s.invalidRequest(w, req, errors.Wrap(field, errors.Invalid, "invalid request body"))
+		return
+	} else if err != nil {
+		s.invalidRequest(w, req, errors.Wrap(err, errors.Malformed, "request body must be a JSON object"))
 		return
 	}
 
+	var inputErrors error
 	if len(body.ProductId) == 0 { // TODO length constraints? charset constraints?
-		http.Error(w, "invalid or missing productId (must be non empty string)", http.StatusBadRequest)
+		errors.Collect(&inputErrors, errors.Field{Name: "productId", Code: fieldRequired, Reason: "must be a non empty string"})
+	}
+	if body.Price == json.Number("") {
+		errors.Collect(&inputErrors, errors.Field{Name: "price", Code: fieldRequired, Reason: "must be a positive number"})
+	} else if body.Price == json.Number("0") {
+		errors.Collect(&inputErrors, errors.Field{Name: "price", Code: fieldInvalidValue, Reason: "must be a positive number"})
+	}
+	if inputErrors != nil {
+		s.invalidRequest(w, req, errors.Wrap(inputErrors, errors.Invalid, "invalid request body"))
 		return
 	}
 
-	if body.Price == json.Number("0") || body.Price == json.Number("") {
-		http.Error(w, "invalid or missing price (must be positive number)", http.StatusBadRequest)
+	if !allowedProduct(w, req, body.ProductId) {
 		return
 	}
 
-	// write the new price data to storage.
-	err = s.UpdatePrice(body.ProductId, body.Price)
-	if err != nil {
-		code := http.StatusInternalServerError
-
-		if _, ok := err.(interface{ Temporary() bool }); ok {
-			code = http.StatusServiceUnavailable
-		}
+	// the origin of the update is stored with it
+	req = req.WithContext(provenance.NewContext(req.Context(), requestProvenance(req)))
 
-		// TODO log err, if code = 503, only warn
+	if durable, ok := s.PriceUpdater.(DurablePriceUpdater); ok && (opts.DurableWrites || prefersDurable(req)) {
+		s.updateDurable(w, req, durable, body.ProductId, body.Price)
+		return
+	}
 
-		http.Error(w, http.StatusText(code), code)
+	// write the new price data to storage. with a deadline the model may
+	// wait for write capacity to absorb a short burst instead of rejecting
+	// the update
+	ctx := req.Context()
+	if opts.QueueWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.QueueWait)
+		defer cancel()
+	}
+	err = s.UpdatePrice(ctx, body.ProductId, body.Price)
+	if err != nil {
+		s.updateError(w, req, err)
 		return
 	}
 
@@ -76,3 +157,169 @@ func (s reprice) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// to disk? UpdatePrice() could be called in a new goroutine instead
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// updateDurable writes the new price data to storage, and waits for it to be
+// stored before responding with the finalized record
+func (s reprice) updateDurable(w http.ResponseWriter, req *http.Request, m DurablePriceUpdater, productId string, price json.Number) {
+	previousPrice, t, err := m.UpdatePriceDurable(req.Context(), productId, price)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		// the update was still accepted, but it's not known whether
+		// or not it was stored
+		logging.FromContext(req.Context()).Warn("stopped waiting for durable update", "product_id", productId, "error", err)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	} else if err != nil {
+		s.updateError(w, req, err)
+		return
+	}
+
+	var body struct {
+		ProductId     string      `json:"productId"`
+		Price         json.Number `json:"price"`
+		PreviousPrice json.Number `json:"previousPrice,omitempty"`
+		Timestamp     epochTime   `json:"timestamp"`
+	}
+
+	body.ProductId = productId
+	body.Price = price
+	body.PreviousPrice = previousPrice
+	body.Timestamp = epochTime(t)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Preference-Applied", preferDurable)
+	w.WriteHeader(http.StatusCreated)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	if err := e.Encode(body); err != nil {
+		logging.FromContext(req.Context()).Error("encoding response", "error", err)
+	}
+}
+
+func requestProvenance(req *http.Request) provenance.Provenance {
+	p := provenance.Provenance{
+		ClientIP:  clientIP(req),
+		UserAgent: truncate(req.UserAgent(), maxProvenanceFieldLength),
+		RequestID: logging.RequestID(req.Context()),
+		Source:    truncate(req.Header.Get(SourceHeader), maxProvenanceFieldLength),
+	}
+
+	if id := req.Header.Get(RequestIDHeader); validRequestID(id) {
+		p.ClientRequestID = id
+	}
+
+	if principal := auth.FromContext(req.Context()); principal != nil {
+		p.Principal = principal.Name
+	}
+
+	return p
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// verifySignature checks the signature of a request body, responding with 401
+// if it's rejected
+func (s reprice) verifySignature(w http.ResponseWriter, req *http.Request, signatures *auth.SignatureVerifier, body []byte) bool {
+	log := logging.FromContext(req.Context())
+
+	secretID, err := signatures.Verify(
+		req.Header.Get(SignatureTimestampHeader),
+		req.Header.Get(SignatureNonceHeader),
+		req.Header.Get(SignatureHeader),
+		body,
+		time.Now(),
+	)
+	if err != nil {
+		reason, _ := err.(auth.SignatureError)
+		s.badSigs[reason].Inc()
+		log.Warn("signature rejected", "reason", string(reason))
+		writeProblem(w, req, errors.Status(err), codeSignaturePrefix+string(reason), err.Error(), nil)
+		return false
+	}
+
+	log.Debug("signature verified", "secret_id", secretID)
+	return true
+}
+
+// invalidRequest responds with 400, and is kept apart from signature
+// rejections in logs and metrics
+func (s reprice) invalidRequest(w http.ResponseWriter, req *http.Request, err error) {
+	s.invalid.Inc()
+	logging.FromContext(req.Context()).Info("invalid reprice request", "error", err)
+	writeError(w, req, err)
+}
+
+// decodeError translates errors of json.Decoder describing a specific field
+// into an errors.Field
+func decodeError(err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		return errors.Field{Name: e.Field, Code: fieldInvalidType, Reason: "must be a " + e.Type.String()}
+	case nil:
+		return nil
+	}
+
+	// DisallowUnknownFields has no error type
+	const unknownField = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknownField) {
+		if name, err := strconv.Unquote(strings.TrimPrefix(msg, unknownField)); err == nil {
+			return errors.Field{Name: name, Code: fieldUnknown, Reason: "unknown field"}
+		}
+	}
+
+	return err
+}
+
+func (s reprice) updateError(w http.ResponseWriter, req *http.Request, err error) {
+	log := logging.FromContext(req.Context())
+
+	if errors.CodeOf(err) == errors.Unavailable {
+		s.rejected.Inc()
+		log.Warn("rejected price update", "error", err)
+
+		// the model may estimate when it will have capacity again
+		var hint interface{ RetryAfter() time.Duration }
+		if errors.As(err, &hint) {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(hint.RetryAfter())))
+		}
+
+		writeError(w, req, errors.Wrap(err, errors.Unavailable, "price updates are temporarily rejected, retry later"))
+		return
+	}
+
+	log.Error("updating price", "error", err)
+	writeError(w, req, err)
+}
+
+// retryAfterSeconds rounds a delay up to whole seconds, which is at least 1
+// since a Retry-After of 0 invites an immediate retry
+func retryAfterSeconds(d time.Duration) int {
+	if s := seconds(d); s > 1 {
+		return s
+	}
+	return 1
+}
+
+// clients can request durable writes with an RFC 7240 preference
+const preferDurable = "durable"
+
+func prefersDurable(req *http.Request) bool {
+	for _, header := range req.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			// ignore any parameters
+			if i := strings.IndexByte(preference, ';'); i != -1 {
+				preference = preference[:i]
+			}
+
+			if strings.EqualFold(strings.TrimSpace(preference), preferDurable) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
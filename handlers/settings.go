@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Handler serves the API, see API. Its options can be replaced while it's
+// serving requests.
+type Handler struct {
+	handler http.Handler
+
+	mu       sync.Mutex   // serializes reloads
+	settings atomic.Value // *settings
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := h.settings.Load().(*settings)
+	h.handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), settingsKey{}, s)))
+}
+
+// Reload replaces the options of the API. Requests which are already being
+// handled keep the options they started with. Metrics and Logger can't be
+// replaced, and are ignored.
+//
+// When MaxInFlight changes the concurrency limits of the product and query
+// endpoints start over, so requests still holding the previous limits may
+// briefly exceed the new ones.
+func (h *Handler) Reload(opts Options) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prev, _ := h.settings.Load().(*settings)
+	h.settings.Store(newSettings(opts, prev))
+}
+
+// settings are the options a request is handled with
+type settings struct {
+	Options
+	semaphores map[string]chan struct{} // bound concurrent requests, by endpoint
+}
+
+// endpoints constructed on their own, rather than by API, use the defaults
+var defaultSettings = newSettings(Options{}, nil)
+
+func newSettings(opts Options, prev *settings) *settings {
+	s := &settings{Options: opts.withDefaults()}
+
+	if prev != nil && prev.MaxInFlight == s.MaxInFlight {
+		s.semaphores = prev.semaphores
+	} else {
+		s.semaphores = map[string]chan struct{}{
+			"product": make(chan struct{}, s.MaxInFlight),
+			"query":   make(chan struct{}, s.MaxInFlight),
+		}
+	}
+
+	return s
+}
+
+type settingsKey struct{}
+
+// current returns the settings of a request
+func current(req *http.Request) *settings {
+	if s, ok := req.Context().Value(settingsKey{}).(*settings); ok {
+		return s
+	}
+	return defaultSettings
+}
@@ -0,0 +1,181 @@
+// Package logging implements a leveled logger that writes structured log
+// entries as JSON lines.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name as returned by Level.String
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Logger writes entries at or above its level as JSON objects, one per line,
+// with "time", "level" and "msg" keys followed by any fields.
+//
+// A nil *Logger discards all entries, so logging is optional.
+type Logger struct {
+	out    *output
+	level  *int32        // a Level, shared with derived loggers
+	fields []interface{} // key value pairs added to every entry
+}
+
+type output struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// New constructs a logger writing to w
+func New(w io.Writer, level Level) *Logger {
+	l := int32(level)
+	return &Logger{out: &output{w: w}, level: &l}
+}
+
+// SetLevel changes the level of a logger, and of all loggers derived from it
+// or from the same logger with With
+func (l *Logger) SetLevel(level Level) {
+	if l != nil {
+		atomic.StoreInt32(l.level, int32(level))
+	}
+}
+
+// With returns a logger which adds the given key value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// Enabled reports whether entries of a given level are written
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && int32(level) >= atomic.LoadInt32(l.level)
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.Log(Debug, msg, keyvals...) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.Log(Info, msg, keyvals...) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.Log(Warn, msg, keyvals...) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.Log(Error, msg, keyvals...) }
+
+// Log writes an entry with the given key value pairs, keys must be strings.
+// Errors are logged by their message.
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	writeField(&b, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	writeField(&b, "level", level.String())
+	b.WriteByte(',')
+	writeField(&b, "msg", msg)
+
+	for _, kv := range [][]interface{}{l.fields, keyvals} {
+		for i := 0; i < len(kv); i += 2 {
+			key, ok := kv[i].(string)
+			if !ok {
+				key = fmt.Sprint(kv[i])
+			}
+
+			var value interface{} = "(missing)"
+			if i+1 < len(kv) {
+				value = kv[i+1]
+			}
+
+			b.WriteByte(',')
+			writeField(&b, key, value)
+		}
+	}
+	b.WriteString("}\n")
+
+	l.out.Lock()
+	defer l.out.Unlock()
+	_, _ = io.WriteString(l.out.w, b.String()) // nowhere to report this error
+}
+
+func writeField(b *strings.Builder, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(v)
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a context carrying a logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the logger carried by ctx, or nil if there is none
+func FromContext(ctx context.Context) *Logger {
+	l, _ := ctx.Value(loggerKey).(*Logger)
+	return l
+}
+
+// WithRequestID returns a context carrying a request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID carried by ctx, or the empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
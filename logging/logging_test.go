@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Info).With("component", "test")
+
+	l.Debug("ignored")
+	l.Warn("something happened", "error", fmt.Errorf("oops"), "count", 3, "dangling")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal("each entry should be a JSON object on a single line", err, buf.String())
+	}
+
+	for k, v := range map[string]interface{}{
+		"level":     "warn",
+		"msg":       "something happened",
+		"component": "test",
+		"error":     "oops",
+		"count":     float64(3),
+		"dangling":  "(missing)",
+	} {
+		if entry[k] != v {
+			t.Errorf("%s should be %v, not %v", k, v, entry[k])
+		}
+	}
+
+	if _, exists := entry["time"]; !exists {
+		t.Error("entry should have a timestamp")
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.With("foo", "bar").Error("discarded")
+
+	if FromContext(context.Background()) != nil {
+		t.Error("context without a logger should return nil")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{Debug, Info, Warn, Error} {
+		if parsed, err := ParseLevel(level.String()); err != nil || parsed != level {
+			t.Error("level should round trip", level, parsed, err)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("unknown levels should be rejected")
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, Info)
+	derived := l.With("component", "test")
+
+	l.SetLevel(Debug)
+	derived.Debug("written")
+	if buf.Len() == 0 {
+		t.Error("level should be changed for derived loggers too")
+	}
+
+	buf.Reset()
+	derived.SetLevel(Error)
+	l.Warn("ignored")
+	if buf.Len() != 0 {
+		t.Error("level should be shared with the parent logger", buf.String())
+	}
+}
@@ -1,25 +1,252 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/nothingmuch/repricer/errors"
 	"github.com/nothingmuch/repricer/handlers"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
 	"github.com/nothingmuch/repricer/storage"
 )
 
+// how long to wait for in flight requests to complete when shutting down
+const shutdownTimeout = 20 * time.Second
+
+// commands of the repricer binary by name, each taking the arguments that
+// follow its name and returning the exit status
+var commands = map[string]func(args []string) int{
+	"serve":   serve,
+	"fsck":    fsck,
+	"export":  exportPrices,
+	"import":  importPrices,
+	"reindex": reindex,
+	"stat":    stat,
+	"bench":   bench,
+	"backup":  backup,
+	"restore": restore,
+}
+
+const usage = `usage: repricer [command] [flags] [arguments]
+
+commands:
+  serve    serve the API (the default if no command is given)
+  fsck     check the consistency of a data directory
+  export   write the price history of a data directory as JSON lines
+  import   write price history into a new data directory
+  reindex  rebuild the product directories from the results directory
+  stat     summarize the contents of a data directory
+  bench    load test a running server
+  backup   write a tar archive of a data directory, even while it's in use
+  restore  extract a backup into a new data directory
+
+run repricer <command> -h for the flags of a command
+`
+
 func main() {
-	apiMux := handlers.API(storage.New("."))
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		fmt.Print(usage)
+		return
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+
+	os.Exit(command(args))
+}
+
+// serve runs the service until it receives SIGTERM or SIGINT
+func serve(args []string) int {
+	load := func() (config, error) {
+		cfg, _, err := loadConfig("serve", args, os.LookupEnv)
+		return cfg, err
+	}
+	cfg, err := load()
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	res, err := loadResources(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log := logging.New(os.Stderr, res.level)
+
+	if res.keys == nil {
+		log.Warn("authentication is disabled, all clients can update prices")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// until the data directory lock has been acquired the model is unset
+	var model interface {
+		handlers.Model
+		Health() storage.Health
+		RegisterMetrics(*metrics.Registry)
+		Close() error
+	}
+	ready := make(chan struct{})
+
+	registry := metrics.NewRegistry()
+	srv := newServer(load, cfg, res, log, registry)
+
+	// on SIGHUP the configuration is reloaded, which can also be requested
+	// on the admin address
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		for range hangups {
+			if _, err := srv.reload(); err != nil {
+				log.Error("reloading configuration", "error", err)
+			}
+		}
+	}()
 
 	go func() {
-		// just a fake set of healthchecks since the app currently entirely statless
+		health := func() handlers.HealthStatus {
+			select {
+			case <-ready:
+				return model.Health()
+			default:
+				return standbyStatus{Standby: true}
+			}
+		}
 		backplaneMux := http.NewServeMux()
-		alwaysOK := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusOK) })
-		backplaneMux.Handle("/healthz/alive", alwaysOK)
-		backplaneMux.Handle("/healthz/ready", alwaysOK)
-		_ = http.ListenAndServe(":9102", backplaneMux)
+		backplaneMux.Handle("/healthz/", handlers.Backplane(health))
+		backplaneMux.Handle("/metrics", registry)
+		fatal(log, "serving backplane", http.ListenAndServe(cfg.BackplaneAddr, backplaneMux))
 	}()
 
-	log.Fatal(http.ListenAndServe(":8080", apiMux))
+	// the administrative endpoints are unauthenticated, so they are served
+	// separately from the backplane, which is reachable from the cluster
+	if cfg.AdminAddr != "" {
+		go func() {
+			// a degraded model never links the file it failed to
+			// write, so the backup would wait for it in vain
+			healthy := func() error {
+				select {
+				case <-ready:
+					if h := model.Health(); h.Degraded != "" {
+						return errors.New(errors.Unavailable, "persistent storage degraded: "+h.Degraded)
+					}
+				default:
+				}
+				return nil
+			}
+			admin := handlers.Admin(srv.reload, func(ctx context.Context, w io.Writer) error {
+				_, err := storage.Backup(ctx, storage.OS(cfg.DataDir), w, storage.BackupOptions{Healthy: healthy})
+				return err
+			}, handlers.AdminOptions{})
+			fatal(log, "serving admin endpoints", http.ListenAndServe(cfg.AdminAddr, admin))
+		}()
+	}
 
+	// on SIGTERM stop accepting connections and wait for in flight requests,
+	// so that every 202 response corresponds to a persisted record. in
+	// standby there's nothing to wait for.
+	var (
+		mu       sync.Mutex
+		server   *http.Server
+		stopping bool
+	)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		log.Info("shutting down", "signal", sig)
+
+		mu.Lock()
+		stopping = true
+		server := server
+		mu.Unlock()
+
+		if server == nil {
+			cancel()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Error("shutting down server", "error", err)
+		}
+	}()
+
+	if cfg.Standby {
+		log.Info("waiting for data directory lock")
+	}
+	storageOpts := cfg.storageOptions()
+	storageOpts.Logger = log
+	m, err := storage.New(ctx, storageOpts)
+	if err == context.Canceled {
+		return 0
+	} else if err != nil {
+		fatal(log, "opening storage", err)
+	}
+
+	model = m
+	model.RegisterMetrics(registry)
+
+	mu.Lock()
+	if stopping {
+		mu.Unlock()
+		_ = model.Close()
+		return 0
+	}
+	server = &http.Server{Addr: cfg.Addr, Handler: srv.serveAPI(model)}
+	mu.Unlock()
+
+	close(ready)
+
+	log.Info("serving requests", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fatal(log, "serving requests", err)
+	}
+	<-shutdown
+
+	// flush and sync all accepted writes
+	if err := model.Close(); err != nil {
+		fatal(log, "closing storage", err)
+	}
+
+	return 0
 }
+
+func fatal(log *logging.Logger, msg string, err error) {
+	log.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// reported by health checks while waiting for the data directory lock
+type standbyStatus struct {
+	Standby bool `json:"standby"`
+}
+
+func (standbyStatus) Alive() bool { return true }
+func (standbyStatus) Ready() bool { return false }
@@ -0,0 +1,120 @@
+// Package metrics implements the small subset of Prometheus instrumentation
+// needed by the service, without depending on the client library.
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Metric is a value that can be written in the Prometheus text format
+type Metric interface {
+	metricType() string
+	samples(emit func(suffix string, extra Labels, value float64))
+}
+
+// Counter is a monotonically increasing count. A nil *Counter discards
+// increments, so that instrumentation is optional.
+type Counter struct{ n uint64 }
+
+func NewCounter() *Counter { return &Counter{} }
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(n uint64) {
+	if c != nil {
+		atomic.AddUint64(&c.n, n)
+	}
+}
+
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.n)
+}
+
+func (c *Counter) metricType() string { return "counter" }
+func (c *Counter) samples(emit func(string, Labels, float64)) {
+	emit("", nil, float64(c.Value()))
+}
+
+// GaugeFunc is a gauge whose value is computed when it's collected
+type GaugeFunc func() float64
+
+func (GaugeFunc) metricType() string { return "gauge" }
+func (g GaugeFunc) samples(emit func(string, Labels, float64)) {
+	emit("", nil, g())
+}
+
+// Histogram counts observations in cumulative buckets. A nil *Histogram
+// discards observations.
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // per bucket, not cumulative, last one is +Inf
+	count       uint64
+	sumBits     uint64 // float64 bits
+}
+
+// DefaultBuckets are suitable for latencies measured in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// LinearBuckets returns n buckets of the given width starting at start
+func LinearBuckets(start, width float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start + float64(i)*width
+	}
+	return buckets
+}
+
+// NewHistogram constructs a histogram with the given sorted upper bounds,
+// the +Inf bucket is implicit
+func NewHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+
+	i := 0
+	for i < len(h.upperBounds) && v > h.upperBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// ObserveSince observes the time elapsed since start, in seconds
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) metricType() string { return "histogram" }
+func (h *Histogram) samples(emit func(string, Labels, float64)) {
+	// the sample values are not read atomically as a whole, so the count
+	// may be slightly inconsistent with the buckets under concurrent use
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		emit("_bucket", Labels{"le": formatFloat(upperBound)}, float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+	emit("_bucket", Labels{"le": "+Inf"}, float64(cumulative))
+	emit("_sum", nil, math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	emit("_count", nil, float64(atomic.LoadUint64(&h.count)))
+}
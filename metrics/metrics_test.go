@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	c := NewCounter()
+	r.Register("requests_total", "Requests served.", Labels{"endpoint": `"quoted"`}, c)
+	c.Inc()
+	c.Add(2)
+
+	r.Register("queue_length", "Queued items.", nil, GaugeFunc(func() float64 { return 7 }))
+
+	h := NewHistogram([]float64{1, 2.5})
+	r.Register("latency_seconds", "Latency.\nIn seconds.", Labels{"endpoint": "a"}, h)
+	h.Observe(0.5)
+	h.Observe(1)
+	h.Observe(2)
+	h.Observe(10)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP latency_seconds Latency.\nIn seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="a",le="1"} 2
+latency_seconds_bucket{endpoint="a",le="2.5"} 3
+latency_seconds_bucket{endpoint="a",le="+Inf"} 4
+latency_seconds_sum{endpoint="a"} 13.5
+latency_seconds_count{endpoint="a"} 4
+# HELP queue_length Queued items.
+# TYPE queue_length gauge
+queue_length 7
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{endpoint="\"quoted\""} 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected exposition:\n%s", buf.String())
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	// instrumentation is optional, so nil metrics must be usable
+	var c *Counter
+	var h *Histogram
+	var r *Registry
+
+	c.Inc()
+	h.Observe(1)
+	r.Register("foo", "", nil, c)
+
+	if c.Value() != 0 {
+		t.Error("nil counter should have no value")
+	}
+}
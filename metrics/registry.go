@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels distinguish metrics with the same name
+type Labels map[string]string
+
+// Registry collects metrics and serves them in the Prometheus text exposition
+// format. It's safe for concurrent use.
+type Registry struct {
+	sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	name, help, typ string
+	series          []series
+}
+
+type series struct {
+	labels Labels
+	Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Register adds a metric. Metrics with the same name must have the same type
+// and distinct labels. A nil *Registry ignores registrations.
+func (r *Registry) Register(name, help string, labels Labels, m Metric) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	f, exists := r.families[name]
+	if !exists {
+		f = &family{name: name, help: help, typ: m.metricType()}
+		r.families[name] = f
+	} else if f.typ != m.metricType() {
+		panic(fmt.Sprintf("metric %s registered as %s and %s", name, f.typ, m.metricType()))
+	}
+
+	f.series = append(f.series, series{labels, m})
+}
+
+// WriteTo writes all registered metrics, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		f := *r.families[name]
+		f.series = append([]series(nil), f.series...)
+		families = append(families, f)
+	}
+	r.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{Writer: bw}
+	for _, f := range families {
+		fmt.Fprintf(cw, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", f.name, f.typ)
+
+		for _, s := range f.series {
+			s.samples(func(suffix string, extra Labels, value float64) {
+				fmt.Fprintf(cw, "%s%s%s %s\n", f.name, suffix, formatLabels(s.labels, extra), formatFloat(value))
+			})
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w) // TODO log error if any, only likely to be IO errors
+}
+
+type countingWriter struct {
+	io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func formatLabels(labels, extra Labels) string {
+	if len(labels)+len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)+len(extra))
+	for _, l := range []Labels{labels, extra} {
+		for k, v := range l {
+			pairs = append(pairs, k+`="`+escapeLabelValue(v)+`"`)
+		}
+	}
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelValueEscaper.Replace(s) }
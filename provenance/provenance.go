@@ -0,0 +1,29 @@
+// Package provenance describes the origin of price updates, which is stored
+// with every record as an audit trail.
+package provenance
+
+import "context"
+
+// Provenance of a price update. All fields are optional.
+type Provenance struct {
+	Principal       string `json:"principal,omitempty"` // name of the authenticated client
+	ClientIP        string `json:"clientIp,omitempty"`
+	UserAgent       string `json:"userAgent,omitempty"`
+	RequestID       string `json:"requestId,omitempty"`       // generated by the server
+	ClientRequestID string `json:"clientRequestId,omitempty"` // as provided by the client, so it may not be unique
+	Source          string `json:"source,omitempty"`          // system the update originated from, as declared by the client
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the provenance of an update
+func NewContext(ctx context.Context, p Provenance) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the provenance carried by ctx, which is zero valued if
+// there is none
+func FromContext(ctx context.Context) Provenance {
+	p, _ := ctx.Value(contextKey{}).(Provenance)
+	return p
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nothingmuch/repricer/storage"
+)
+
+// reindex rebuilds the product directories from the results directory. The
+// data directory is locked, so the server must not be running.
+func reindex(args []string) int {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer reindex [data directory]")
+		flags.PrintDefaults()
+	}
+	verbose := flags.Bool("v", false, "list the links that were created")
+	_ = flags.Parse(args)
+
+	dir, ok := dataDir(flags)
+	if !ok {
+		return 2
+	}
+
+	report, err := storage.Reindex(context.Background(), dir)
+	if *verbose {
+		for _, repair := range report.Repairs {
+			fmt.Println("repaired", repair)
+		}
+	}
+	for _, violation := range report.Violations {
+		fmt.Println(violation)
+	}
+
+	fmt.Fprintf(os.Stderr, "reindexed %d files: %d links, %d violations\n", report.Files, len(report.Repairs), len(report.Violations))
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reindex aborted:", err)
+		return 2
+	}
+
+	if len(report.Violations) > 0 {
+		return 1
+	}
+
+	return 0
+}
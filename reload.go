@@ -0,0 +1,165 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nothingmuch/repricer/auth"
+	"github.com/nothingmuch/repricer/handlers"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
+)
+
+// resources are loaded from the files referenced by a config, which are read
+// again on every reload
+type resources struct {
+	level   logging.Level
+	keys    *auth.Keys        // nil if authentication is disabled
+	secrets map[string][]byte // nil if signatures are not required
+}
+
+// loadResources validates a config, loading the files it references
+func loadResources(cfg config) (r resources, err error) {
+	if r.level, err = logging.ParseLevel(cfg.LogLevel); err != nil {
+		return r, err
+	}
+
+	if cfg.APIKeys != "" {
+		if r.keys, err = auth.LoadKeys(cfg.APIKeys); err != nil {
+			return r, err
+		}
+	}
+
+	if cfg.SigningSecrets != "" {
+		if r.secrets, err = auth.LoadSecrets(cfg.SigningSecrets); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+// server holds the configuration in effect, and applies reloaded
+// configurations to the running service
+type server struct {
+	load func() (config, error) // loads the config again
+
+	log      *logging.Logger
+	registry *metrics.Registry
+
+	sync.Mutex
+	cfg        config
+	res        resources
+	signatures *auth.SignatureVerifier
+	api        *handlers.Handler // nil until the storage model has been opened
+}
+
+func newServer(load func() (config, error), cfg config, res resources, log *logging.Logger, registry *metrics.Registry) *server {
+	s := &server{load: load, log: log, registry: registry, cfg: cfg, res: res}
+	if res.secrets != nil {
+		s.signatures = auth.NewSignatureVerifier(res.secrets, time.Duration(cfg.SignatureWindow))
+	}
+	return s
+}
+
+// apiOptions must be called with the lock held
+func (s *server) apiOptions() handlers.Options {
+	return handlers.Options{
+		DurableWrites: s.cfg.Durable,
+		QueueWait:     time.Duration(s.cfg.QueueWait),
+		Signatures:    s.signatures,
+		Keys:          s.res.keys,
+		RateLimits:    s.cfg.RateLimits,
+		MaxInFlight:   s.cfg.MaxInFlight,
+		PageSize:      s.cfg.PageSize,
+		Metrics:       s.registry,
+		Logger:        s.log,
+	}
+}
+
+// serveAPI constructs the API handler for a model, which is updated by
+// subsequent reloads
+func (s *server) serveAPI(m handlers.Model) *handlers.Handler {
+	s.Lock()
+	defer s.Unlock()
+
+	s.api = handlers.API(m, s.apiOptions())
+	return s.api
+}
+
+// reload loads the configuration again, and if it's valid applies all of the
+// changed settings that don't require a restart. The files it references are
+// read again even if their names haven't changed, so that keys and secrets
+// can be rotated.
+func (s *server) reload() (handlers.ReloadResult, error) {
+	var result handlers.ReloadResult
+
+	cfg, err := s.load()
+	if err != nil {
+		return result, err
+	}
+	res, err := loadResources(cfg)
+	if err != nil {
+		return result, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	result.Applied, result.RestartRequired = cfg.diff(s.cfg)
+
+	// settings that can't be changed keep their values until the restart,
+	// so that they're reported again by subsequent reloads
+	cfg.keepRestartRequired(s.cfg)
+
+	s.log.SetLevel(res.level)
+
+	if res.secrets == nil {
+		s.signatures = nil
+	} else if s.signatures == nil {
+		s.signatures = auth.NewSignatureVerifier(res.secrets, time.Duration(cfg.SignatureWindow))
+	} else {
+		// the verifier remembers nonces, so it's kept to prevent
+		// replays of requests it has already accepted
+		s.signatures.SetSecrets(res.secrets, time.Duration(cfg.SignatureWindow), time.Now())
+	}
+
+	s.cfg, s.res = cfg, res
+	if s.api != nil {
+		s.api.Reload(s.apiOptions())
+	}
+
+	s.log.Info("reloaded configuration", "applied", result.Applied, "restart_required", result.RestartRequired)
+	return result, nil
+}
+
+// diff returns the JSON names of the fields of c which differ from old, split
+// by whether a restart is required for them to take effect
+func (c config) diff(old config) (applied, restartRequired []string) {
+	v, o := reflect.ValueOf(c), reflect.ValueOf(old)
+	for i := 0; i < v.NumField(); i++ {
+		if reflect.DeepEqual(v.Field(i).Interface(), o.Field(i).Interface()) {
+			continue
+		}
+
+		field := v.Type().Field(i)
+		if field.Tag.Get("reload") == "restart" {
+			restartRequired = append(restartRequired, field.Tag.Get("json"))
+		} else {
+			applied = append(applied, field.Tag.Get("json"))
+		}
+	}
+	return
+}
+
+// keepRestartRequired sets the fields of c which require a restart to their
+// values in old
+func (c *config) keepRestartRequired(old config) {
+	v, o := reflect.ValueOf(c).Elem(), reflect.ValueOf(old)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("reload") == "restart" {
+			v.Field(i).Set(o.Field(i))
+		}
+	}
+}
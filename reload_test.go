@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
+)
+
+func TestReload(t *testing.T) {
+	cfg := defaultConfig()
+	res, err := loadResources(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := cfg
+	load := func() (config, error) { return next, nil }
+	s := newServer(load, cfg, res, logging.New(ioutil.Discard, logging.Info), metrics.NewRegistry())
+
+	next.Addr = ":1"
+	next.PageSize = 3
+	next.SignatureWindow = duration(time.Minute)
+	result, err := s.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 2 || result.Applied[0] != "signatureWindow" || result.Applied[1] != "pageSize" {
+		t.Error("changed settings should be applied", result.Applied)
+	}
+	if len(result.RestartRequired) != 1 || result.RestartRequired[0] != "addr" {
+		t.Error("settings that can't be reloaded should be reported", result.RestartRequired)
+	}
+	if s.cfg.Addr != cfg.Addr || s.cfg.PageSize != 3 {
+		t.Error("only settings that can be reloaded should be changed", s.cfg.Addr, s.cfg.PageSize)
+	}
+
+	if result, _ := s.reload(); len(result.Applied) != 0 || len(result.RestartRequired) != 1 {
+		t.Error("pending restarts should be reported again", result)
+	}
+
+	next.LogLevel = "verbose"
+	if _, err := s.reload(); err == nil {
+		t.Error("invalid configurations should be rejected")
+	}
+	if s.cfg.LogLevel != cfg.LogLevel || s.cfg.PageSize != 3 {
+		t.Error("invalid configurations should not be applied", s.cfg)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nothingmuch/repricer/storage"
+)
+
+// stat prints a summary of a data directory as JSON. Like fsck it's safe to
+// run against the data directory of a live server.
+func stat(args []string) int {
+	flags := flag.NewFlagSet("stat", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: repricer stat [data directory]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	dir, ok := dataDir(flags)
+	if !ok {
+		return 2
+	}
+
+	stats, err := storage.Stat(storage.OS(dir))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "\t")
+	_ = e.Encode(stats)
+
+	return 0
+}
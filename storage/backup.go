@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+// DefaultBackupPollInterval is the default of BackupOptions.PollInterval
+const DefaultBackupPollInterval = 50 * time.Millisecond
+
+// BackupOptions configures Backup. Zero values are replaced by defaults.
+type BackupOptions struct {
+	// PollInterval is how often a backup checks whether the files it
+	// includes have been finalized
+	PollInterval time.Duration
+
+	// Healthy, if not nil, is called while waiting for files to be
+	// finalized, and the backup is aborted with its error
+	Healthy func() error
+}
+
+func (o BackupOptions) withDefaults() BackupOptions {
+	if o.PollInterval <= 0 {
+		o.PollInterval = DefaultBackupPollInterval
+	}
+	return o
+}
+
+// Backup writes a tar archive of a data directory to w, which can be made
+// while the directory is being written to.
+//
+// The archive contains the results files up to and including the last one
+// that exists when the backup starts, and their links in the product
+// directories, which are archived as hard links. Before anything is written,
+// Backup waits until all of these files have been synced and linked, or until
+// ctx is done. Files written after the backup started are not included, nor is
+// the write ahead log, so a restored archive is consistent.
+//
+// A file whose write failed is never linked, so if opts.Healthy is not nil
+// it's called while waiting, and the backup is aborted with its error. This is
+// meant to report whether the model writing to the directory is degraded.
+//
+// It returns the fileSeq of the last file in the archive, which is 0 if the
+// data directory is empty, in which case the archive is empty too.
+func Backup(ctx context.Context, fs readFS, w io.Writer, opts BackupOptions) (lastFileSeq int64, err error) {
+	opts = opts.withDefaults()
+
+	files, err := fs.Sub(ResultsSubdirectory).Files()
+	if err != nil {
+		return 0, err
+	} else if len(files) == 0 {
+		return 0, tar.NewWriter(w).Close()
+	}
+
+	var last filename
+	if err := last.parse(files[len(files)-1]); err != nil {
+		return 0, errors.Wrap(err, errors.Corrupt, "unparseable filename "+files[len(files)-1])
+	}
+
+	snapshot := snapshotFS{
+		bound:  filename{fileSeq: last.fileSeq + 1}.String(),
+		readFS: fs,
+	}
+
+	results, err := waitFinalized(ctx, snapshot, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	tw := tar.NewWriter(w)
+
+	// results files are archived first, so that the links to them can be
+	// restored in order
+	byFileSeq := make(map[int64]string, len(results))
+	for _, f := range results {
+		name := filepath.Join(ResultsSubdirectory, f.String())
+		byFileSeq[f.fileSeq] = name
+
+		if err := archiveFile(tw, snapshot, name, f.start); err != nil {
+			return 0, err
+		}
+	}
+
+	// the bound only applies to the files in the product directories, not
+	// to the names of the directories
+	hashes, err := fs.Sub(ProductSubdirectory).Files()
+	if err != nil {
+		return 0, err
+	}
+	for _, hash := range hashes {
+		names, err := snapshot.Sub(filepath.Join(ProductSubdirectory, hash)).Files()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, name := range names {
+			var f filename
+			if err := f.FromString(name); err != nil {
+				return 0, err
+			}
+
+			target, exists := byFileSeq[f.fileSeq]
+			if !exists {
+				return 0, &errors.Error{Code: errors.Corrupt, Path: filepath.Join(ProductSubdirectory, hash, name), Message: "does not match any results file"}
+			}
+
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeLink,
+				Name:     filepath.ToSlash(filepath.Join(ProductSubdirectory, hash, name)),
+				Linkname: filepath.ToSlash(target),
+				ModTime:  f.start,
+				Format:   tar.FormatPAX,
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return last.fileSeq, tw.Close()
+}
+
+// waitFinalized polls the results directory until every file in it has been
+// finalized, i.e. synced and linked into the product directory of each of its
+// productIds, and returns their names
+func waitFinalized(ctx context.Context, fs readFS, opts BackupOptions) ([]filename, error) {
+	var finalized []filename
+	for {
+		names, err := fs.Sub(ResultsSubdirectory).Files()
+		if err != nil {
+			return nil, err
+		}
+
+		// files that were already finalized will not change
+		for _, name := range names[len(finalized):] {
+			var f filename
+			if err := f.FromString(name); err != nil {
+				return nil, err
+			}
+
+			links, err := fs.Links(filepath.Join(ResultsSubdirectory, name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if links < 0 {
+				return nil, &errors.Error{Code: errors.Unsupported, Path: filepath.Join(ResultsSubdirectory, name), Message: "link counts are not supported by this filesystem"}
+			}
+			if links != int(f.nProductIds)+1 {
+				// still being written, or renamed since listing
+				break
+			}
+
+			finalized = append(finalized, f)
+		}
+
+		if len(finalized) == len(names) {
+			return finalized, nil
+		}
+
+		if opts.Healthy != nil {
+			if err := opts.Healthy(); err != nil {
+				return nil, errors.Wrap(err, errors.Unavailable, fmt.Sprintf("waiting for %s to be finalized", names[len(finalized)]))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), errors.Unavailable, fmt.Sprintf("waiting for %s to be finalized", names[len(finalized)]))
+		case <-time.After(opts.PollInterval):
+		}
+	}
+}
+
+func archiveFile(tw *tar.Writer, fs readFS, name string, modTime time.Time) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+
+	// results files are small, and their size must be known in advance
+	data, err := ioutil.ReadAll(f)
+	if c, ok := f.(io.Closer); ok {
+		_ = c.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
+
+// Restore extracts an archive written by Backup, which may be gzip
+// compressed, into a new data directory, which is locked while restoring. It
+// returns the number of results files that were restored.
+func Restore(ctx context.Context, opts Options, r io.Reader) (files int, err error) {
+	opts = opts.withDefaults()
+
+	if err := os.MkdirAll(filepath.Join(opts.Path, ResultsSubdirectory), 0777); err != nil {
+		return 0, err
+	}
+
+	lock, err := lockDirectory(ctx, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.release()
+
+	return restore(osFS(opts.Path), r)
+}
+
+func restore(fs fs, r io.Reader) (files int, err error) {
+	for _, subdirectory := range []string{ResultsSubdirectory, ProductSubdirectory, WALSubdirectory} {
+		if names, err := fs.Sub(subdirectory).Files(); err != nil {
+			return 0, err
+		} else if len(names) > 0 {
+			return 0, errors.New(errors.Invalid, "data directory is not empty")
+		}
+	}
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, errors.Wrap(err, errors.Malformed, "invalid gzip header")
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return files, errors.Wrap(err, errors.Malformed, "invalid archive")
+		}
+
+		if h.Typeflag == tar.TypeDir {
+			// directories are created implicitly
+			continue
+		}
+
+		name, err := archivedName(h.Name)
+		if err != nil {
+			return files, err
+		}
+
+		switch h.Typeflag {
+		case tar.TypeReg:
+			if err := restoreFile(fs, name, tr); err != nil {
+				return files, err
+			}
+			if filepath.Dir(name) == ResultsSubdirectory {
+				files++
+			}
+		case tar.TypeLink:
+			target, err := archivedName(h.Linkname)
+			if err != nil {
+				return files, err
+			}
+			if err := fs.Link(target, name); err != nil {
+				return files, err
+			}
+		default:
+			return files, &errors.Error{Code: errors.Malformed, Path: h.Name, Message: "unsupported file type"}
+		}
+	}
+}
+
+// archivedName validates the name of a file in an archive, which must be a
+// results file or a file in a product directory
+func archivedName(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	valid := path.Clean(name) == name &&
+		((len(parts) == 2 && parts[0] == ResultsSubdirectory) ||
+			(len(parts) == 3 && parts[0] == ProductSubdirectory))
+	if !valid {
+		return "", &errors.Error{Code: errors.Malformed, Path: name, Message: "unexpected file in archive"}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+func restoreFile(fs fs, name string, r io.Reader) error {
+	f, err := fs.New(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+func TestBackup(t *testing.T) {
+	fs := newMemFS()
+	w := batchWriter{fs: fs, maxRecords: 2, flushInterval: time.Minute}
+
+	t0 := time.Now().UTC().Truncate(0)
+	prices := map[string]json.Number{}
+	write := func(productId string, i int) {
+		price := json.Number(fmt.Sprintf("%d.00", i+1))
+		err := w.writeRecord(&record{ProductId: productId, PreviousPrice: prices[productId], entry: entry{Price: price, Time: t0.Add(time.Duration(i))}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prices[productId] = price
+	}
+
+	// the second file is still being written when the backup starts
+	write("foo", 0)
+	write("bar", 1)
+	write("foo", 2)
+
+	type result struct {
+		lastFileSeq int64
+		err         error
+	}
+	var archive bytes.Buffer
+	done := make(chan result)
+	go func() {
+		lastFileSeq, err := Backup(context.Background(), fs, &archive, BackupOptions{PollInterval: time.Millisecond})
+		done <- result{lastFileSeq, err}
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatal("backup should wait for the last file to be finalized", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// the file is flushed, and more records are written after the bound
+	write("bar", 3)
+	write("baz", 4)
+	w.close()
+
+	r := <-done
+	if r.err != nil || r.lastFileSeq != 2 {
+		t.Fatal(r)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, _ = zw.Write(archive.Bytes())
+	_ = zw.Close()
+
+	restored := newMemFS()
+	if files, err := restore(restored, &compressed); err != nil || files != 2 {
+		t.Fatal("archive should be restored", files, err)
+	}
+
+	report, err := Check(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || report.Records != 4 || len(report.Violations) != 0 || len(report.Pending) != 0 {
+		t.Error("restored data directory should be consistent, and not include files after the bound", report)
+	}
+
+	if _, err := restore(restored, bytes.NewReader(archive.Bytes())); errors.CodeOf(err) != errors.Invalid {
+		t.Error("restoring into a data directory that isn't empty should be rejected", err)
+	}
+
+	var malicious bytes.Buffer
+	tw := tar.NewWriter(&malicious)
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "results/../lock", Size: 0})
+	_ = tw.Close()
+	if _, err := restore(newMemFS(), &malicious); errors.CodeOf(err) != errors.Malformed {
+		t.Error("files outside of the results and product directories should be rejected", err)
+	}
+}
+
+func TestBackupDegraded(t *testing.T) {
+	fs := newMemFS()
+	w := batchWriter{fs: fs, maxRecords: 2, flushInterval: time.Minute}
+	defer w.close()
+
+	// the file is never finalized, as if its write had failed
+	err := w.writeRecord(&record{ProductId: "foo", entry: entry{Price: "1.00", Time: time.Now()}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	degraded := errors.New(errors.Internal, "disk full")
+	_, err = Backup(context.Background(), fs, &bytes.Buffer{}, BackupOptions{Healthy: func() error { return degraded }})
+	if errors.CodeOf(err) != errors.Unavailable {
+		t.Error("backup should stop waiting once the model is degraded", err)
+	}
+}
@@ -2,18 +2,20 @@ package storage
 
 import (
 	"encoding/json"
+	"fmt"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
 const (
-	MaxRecordsPerFile   = 10
 	ResultsSubdirectory = "results"
 	ProductSubdirectory = "results_by_product"
-)
 
-var FlushInterval = time.Second // FIXME make into a parameter. turned var from const to make tests more responsive
+	// TemporarySubdirectory holds files which are being prepared before
+	// being atomically moved into place
+	TemporarySubdirectory = "tmp"
+)
 
 // batchWriter is a recordwriter that writes records in batches.
 // it is not safe for concurrent use
@@ -22,28 +24,35 @@ var FlushInterval = time.Second // FIXME make into a parameter. turned var from
 type batchWriter struct {
 	fs
 
+	// fail is called with errors from asynchronous flushes
+	fail func(error)
+
+	metrics modelMetrics
+
+	maxRecords    int           // records per file, after which it's flushed
+	flushInterval time.Duration // after which a file is flushed even if not full
+
 	fileSeq  int64
 	entrySeq int64
 
 	productEntrySeq map[string]int64
 
 	*batch
+	flushing sync.WaitGroup // batches which have not yet been synced
 }
 
-func (w *batchWriter) writeRecord(r *record) (err error) {
+func (w *batchWriter) writeRecord(r *record, synced func(error)) (err error) {
 	err = w.startBatchIfNeeded(r.entry.Time)
 	if err != nil {
 		return
 	}
 
-	// ensure batch is flushed if it's full
-	if w.batch.nRecords+1 == MaxRecordsPerFile {
-		defer w.closeBatch()
-	}
-
+	// the sequence numbers are only advanced once the record is written
+	var productEntrySeq int64
 	defer func() {
 		if err == nil {
 			w.entrySeq++
+			w.productEntrySeq[r.ProductId] = productEntrySeq
 		}
 	}()
 
@@ -53,17 +62,47 @@ func (w *batchWriter) writeRecord(r *record) (err error) {
 	// this lives here because batchWriter sees records to be written in
 	// order, and therefore can maintain a consistent view of these sequence
 	// numbers
+	productEntrySeq, err = w.nextProductEntrySeq(r.ProductId)
+	if err != nil {
+		return
+	}
+
+	err = w.batch.writeRecord(r, productEntrySeq, synced)
+	if err == errBatchFlushed {
+		// the flush timer fired before this record, which was
+		// timestamped within the batch's interval, could be written
+		w.closeBatch()
+		if err = w.startBatchIfNeeded(r.entry.Time); err != nil {
+			return
+		}
+		err = w.batch.writeRecord(r, productEntrySeq, synced)
+	}
+	if err != nil {
+		// the file may contain a partially written record, so it
+		// can't be appended to, and will be repaired on startup
+		w.closeBatch()
+	} else if w.batch.nRecords == int64(w.maxRecords) {
+		// ensure batch is flushed if it's full
+		w.closeBatch()
+	}
+	return
+}
+
+// nextProductEntrySeq returns the entrySeq of the next record of a product.
+// It's only assigned once the record has been written, by updating
+// w.productEntrySeq.
+func (w *batchWriter) nextProductEntrySeq(productId string) (int64, error) {
 	if w.productEntrySeq == nil {
 		// create lazily to avoid polluting other code with this
 		// workaround during construction time
 		w.productEntrySeq = make(map[string]int64)
 	}
 
-	productEntrySeq, exists := w.productEntrySeq[r.ProductId]
+	productEntrySeq, exists := w.productEntrySeq[productId]
 	if !exists {
-		files, err := w.fs.Sub(filepath.Join(ProductSubdirectory, ProductIdHash(r.ProductId))).Files()
+		files, err := w.fs.Sub(filepath.Join(ProductSubdirectory, ProductIdHash(productId))).Files()
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("listing files of %q: %w", productId, err)
 		}
 
 		if len(files) > 0 {
@@ -71,21 +110,91 @@ func (w *batchWriter) writeRecord(r *record) (err error) {
 			var f filename
 			err = f.FromString(files[len(files)-1])
 			if err != nil {
-				return err // TODO wrap
+				return 0, fmt.Errorf("parsing last filename of %q: %w", productId, err)
 			}
 			productEntrySeq = f.entrySeq + f.nRecords - 1
 		}
 	}
 
-	productEntrySeq++
-	w.productEntrySeq[r.ProductId] = productEntrySeq
+	return productEntrySeq + 1, nil
+}
+
+// resume reopens the last results file, which was not finalized before a
+// restart, as the current batch. Its records must already have been read, and
+// must not be linked into the product directories. The file is renamed if its
+// nRecords and nProductIds fields don't match the records.
+//
+// The batch is flushed at the same time as it would have been had the process
+// not restarted.
+func (w *batchWriter) resume(f filename, records []record) (err error) {
+	name := filepath.Join(ResultsSubdirectory, f.String())
+
+	b := &batch{
+		fs:       w.fs,
+		fail:     w.fail,
+		metrics:  w.metrics,
+		flushing: &w.flushing,
+		filename: filename{
+			fileSeq:  f.fileSeq,
+			entrySeq: f.entrySeq,
+			start:    f.start,
+		},
+		end: f.start,
+	}
+
+	err = retry(func() (err error) {
+		b.file, err = w.fs.Append(name)
+		return
+	})
+	if err != nil {
+		return fmt.Errorf("reopening %s: %w", name, err)
+	}
+
+	// the contents may not have been synced before the restart
+	if err := b.file.Sync(); err != nil {
+		_ = b.file.Close()
+		return fmt.Errorf("syncing %s: %w", name, err)
+	}
+
+	// the flush timer may fire immediately, so the batch must not be
+	// flushed until it's been populated
+	b.Lock()
+	defer b.Unlock()
+
+	w.flushing.Add(1)
+	w.metrics.filesWritten.Inc()
+	if err := b.initialize(w.flushInterval); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		productEntrySeq, err := w.nextProductEntrySeq(r.ProductId)
+		if err != nil {
+			return err
+		}
+		b.tally(&r, productEntrySeq)
+		w.productEntrySeq[r.ProductId] = productEntrySeq
+	}
+
+	if b.filename != f {
+		err = retry(func() error {
+			return w.fs.Rename(name, filepath.Join(ResultsSubdirectory, b.filename.String()))
+		})
+		if err != nil {
+			return fmt.Errorf("renaming %s: %w", name, err)
+		}
+	}
+
+	w.fileSeq = b.fileSeq
+	w.entrySeq = b.entrySeq + b.nRecords - 1
+	w.batch = b
 
-	return w.batch.writeRecord(r, productEntrySeq)
+	return nil
 }
 
 func (w *batchWriter) startBatchIfNeeded(now time.Time) (err error) {
 	if w.batch != nil {
-		if now.Sub(w.batch.start) < FlushInterval {
+		if now.Sub(w.batch.start) < w.flushInterval {
 			// batch is set, and OK to use
 			return nil
 		} else {
@@ -95,7 +204,10 @@ func (w *batchWriter) startBatchIfNeeded(now time.Time) (err error) {
 	}
 
 	b := &batch{
-		fs: w.fs,
+		fs:       w.fs,
+		fail:     w.fail,
+		metrics:  w.metrics,
+		flushing: &w.flushing,
 		filename: filename{
 			fileSeq:  w.fileSeq + 1,
 			entrySeq: w.entrySeq + 1,
@@ -106,14 +218,20 @@ func (w *batchWriter) startBatchIfNeeded(now time.Time) (err error) {
 	}
 
 	// FIXME refactor filepath logic into some abstraction
-	b.file, err = w.fs.New(filepath.Join(ResultsSubdirectory, b.filename.String()))
+	name := filepath.Join(ResultsSubdirectory, b.filename.String())
+	err = retry(func() (err error) {
+		b.file, err = w.fs.New(name)
+		return
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("creating %s: %w", name, err)
 	}
 
 	w.fileSeq++
+	w.flushing.Add(1)
+	w.metrics.filesWritten.Inc()
 
-	err = b.initialize()
+	err = b.initialize(w.flushInterval)
 	if err != nil {
 		return err
 	}
@@ -124,13 +242,32 @@ func (w *batchWriter) startBatchIfNeeded(now time.Time) (err error) {
 }
 
 func (w *batchWriter) closeBatch() {
+	if w.batch == nil {
+		return
+	}
+
 	batch := w.batch
 	w.batch = nil
+
+	// the timer would keep the batch reachable until it fires, which may be
+	// never if the flush interval is unbounded
+	batch.timer.Stop()
 	batch.flush()
 }
 
+// close flushes the current batch and waits for all batches to be synced
+func (w *batchWriter) close() {
+	w.closeBatch()
+	w.flushing.Wait()
+}
+
 type batch struct {
-	fs writeFS
+	fs   writeFS
+	fail func(error) // may be nil
+
+	metrics modelMetrics
+
+	err error // set when a write fails, preventing the file from being linked
 
 	filename
 	end time.Time
@@ -140,35 +277,39 @@ type batch struct {
 	file   appendFile
 	synced chan struct{} // closes when synced
 
+	callbacks []func(error) // called with b.err when synced
+
+	timer *time.Timer // flushes the batch once it can no longer be filled
+
 	flushOnce sync.Once
+	flushed   bool            // set when the flush starts, after which no more records can be written
+	flushing  *sync.WaitGroup // marked done when synced
 
 	sync.Mutex // FIXME needed because of outstanding data race
 }
 
+// errBatchFlushed is returned when attempting to write to a batch after its
+// flush timer has fired
+var errBatchFlushed = fmt.Errorf("batch already flushed")
+
 type perProductInfo struct {
 	nRecords int64
 	entrySeq int64
 }
 
-func (b *batch) initialize() error {
-	b.productFields = make(map[string]*perProductInfo, MaxRecordsPerFile)
+func (b *batch) initialize(flushInterval time.Duration) error {
+	b.productFields = make(map[string]*perProductInfo)
 	b.synced = make(chan struct{})
 
-	// FIXME redo with ndjson for robustness
-	_, err := b.file.Write([]byte("[\n\t")) // start a JSON array as per spec
-	if err != nil {
-		return err
-	}
-
 	// ensure buffer is always flushed after it can no longer be filled
-	time.AfterFunc(FlushInterval, func() {
+	b.timer = time.AfterFunc(time.Until(b.start.Add(flushInterval)), func() {
 		b.flush()
 	})
 
 	return nil
 }
 
-func (b *batch) writeRecord(r *record, hackyProductEntrySeq int64) (err error) {
+func (b *batch) writeRecord(r *record, hackyProductEntrySeq int64, synced func(error)) (err error) {
 	if r.entry.Time.Before(b.end) {
 		panic("time went backwards")
 	}
@@ -177,74 +318,142 @@ func (b *batch) writeRecord(r *record, hackyProductEntrySeq int64) (err error) {
 	b.Lock()
 	defer b.Unlock()
 
-	// FIXME ndjson to remove this hack while retaining durability of early writes
-	if b.nRecords > 0 && err == nil {
-		_, err = b.file.Write([]byte(",\n\t"))
-		if err != nil {
-			return
-		}
+	if b.flushed {
+		return errBatchFlushed
 	}
 
-	by, err := json.MarshalIndent(r, "\t", "\t")
+	// records are written as newline delimited JSON, one record per write
+	// so that a crash can only leave a partial line at the end of the
+	// file, which is truncated on startup
+	by, err := json.Marshal(r)
 	if err != nil {
 		return
 	}
 
-	_, err = b.file.Write(by)
+	// partial writes can't be retried, since that would leave a corrupt
+	// line in the middle of the file
+	_, err = b.file.Write(append(by, '\n'))
 	if err != nil {
-		return
+		b.err = fmt.Errorf("writing record: %w", err)
+		return b.err
 	}
 
 	old := b.filename
+	b.tally(r, hackyProductEntrySeq)
+
+	// keep update nRecords and nProducts fields up to date in the filename
+	// TODO abstract ResultsSubdirectory logic
+	oldName := filepath.Join(ResultsSubdirectory, old.String())
+	err = retry(func() error {
+		return b.fs.Rename(oldName, filepath.Join(ResultsSubdirectory, b.filename.String()))
+	})
+	if err != nil {
+		b.err = fmt.Errorf("renaming %s: %w", oldName, err)
+		return b.err
+	}
+
+	if synced != nil {
+		b.callbacks = append(b.callbacks, synced)
+	}
+
+	// TODO how to track entrySeq per product?
+	// could keep track and independently load from snapshot
+	return
+}
+
+// tally updates the filename and per product fields for a record in the file
+func (b *batch) tally(r *record, productEntrySeq int64) {
 	b.nRecords++
 	b.end = r.entry.Time
 	if perProduct, exists := b.productFields[r.ProductId]; !exists {
 		b.nProductIds++
 		b.productFields[r.ProductId] = &perProductInfo{
 			nRecords: 1,
-			entrySeq: hackyProductEntrySeq, // FIXME see above
+			entrySeq: productEntrySeq, // FIXME see above
 		}
 	} else {
 		// only assign nRecords, since we want to know the first
 		// entrySeq in the file
 		perProduct.nRecords++
 	}
-
-	// keep update nRecords and nProducts fields up to date in the filename
-	err = b.fs.Rename(
-		// TODO abstract ResultsSubdirectory logic
-		filepath.Join(ResultsSubdirectory, old.String()),
-		filepath.Join(ResultsSubdirectory, b.filename.String()),
-	)
-
-	// TODO how to track entrySeq per product?
-	// could keep track and independently load from snapshot
-	return
 }
 
 func (b *batch) flush() {
 	b.flushOnce.Do(func() {
+		b.Lock()
+		b.flushed = true
+		b.Unlock()
+
 		go func() {
 			b.Lock() // FIXME still needed due to data race on f.filename, in principle should not be necessary
 			defer b.Unlock()
+			defer b.flushing.Done()
+			defer close(b.synced)
+
+			if err := b.finalize(); err != nil {
+				b.err = err
+				if b.fail != nil {
+					b.fail(err)
+				}
+			}
+
+			for _, synced := range b.callbacks {
+				synced(b.err)
+			}
+		}()
+	})
+}
+
+// finalize syncs and closes the file, and then links it into the product
+// directories
+func (b *batch) finalize() error {
+	// TODO abstract filepath logic
+	finalName := filepath.Join(ResultsSubdirectory, b.filename.String())
+
+	// failed syncs are not retried, since the kernel may have already
+	// discarded the dirty pages, in which case a subsequent sync would
+	// succeed without the data being durable
+	start := time.Now()
+	err := b.file.Sync()
+	b.metrics.resultsSyncSeconds.ObserveSince(start)
+	if err != nil {
+		_ = b.file.Close()
+		return fmt.Errorf("syncing %s: %w", finalName, err)
+	}
 
-			_, _ = b.file.Write([]byte("\n]\n")) // TODO error
-			_ = b.file.Sync()                    // TODO error
-			_ = b.file.Close()                   // TODO error
+	if err := b.file.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", finalName, err)
+	}
 
-			// TODO abstract filepath logic
-			finalName := filepath.Join(ResultsSubdirectory, b.filename.String())
+	// the file was created and renamed since the directory was last
+	// synced, so its final name isn't durable until it is
+	if err := b.fs.SyncDirectory(ResultsSubdirectory); err != nil {
+		return fmt.Errorf("syncing %s: %w", ResultsSubdirectory, err)
+	}
 
-			// link to product index directories
-			for productId, v := range b.productFields {
-				productFilename := b.filename
-				productFilename.nRecords = v.nRecords
-				productFilename.entrySeq = v.entrySeq
+	if b.err != nil {
+		// the failed write was already reported, and since the
+		// file may have a partially written record it should not
+		// be linked until it's repaired on startup
+		return nil
+	}
 
-				_ = b.fs.Link(finalName, filepath.Join(ProductSubdirectory, ProductIdHash(productId), productFilename.String())) // TODO error
-			}
+	// link to product index directories
+	for productId, v := range b.productFields {
+		productFilename := b.filename
+		productFilename.nRecords = v.nRecords
+		productFilename.entrySeq = v.entrySeq
 
-			close(b.synced)
-		}()
-	})
+		link := filepath.Join(ProductSubdirectory, ProductIdHash(productId), productFilename.String())
+		if err := retry(func() error { return b.fs.Link(finalName, link) }); err != nil {
+			return fmt.Errorf("linking %s to %s: %w", finalName, link, err)
+		}
+		if err := b.fs.SyncDirectory(filepath.Dir(link)); err != nil {
+			return fmt.Errorf("syncing %s: %w", filepath.Dir(link), err)
+		}
+	}
+
+	b.metrics.recordsPerFile.Observe(float64(b.nRecords))
+
+	return nil
 }
@@ -10,12 +10,12 @@ import (
 
 func TestBatchWriterContents(t *testing.T) {
 	fs := newMemFS()
-	w := batchWriter{fs: fs}
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval}
 
 	t0 := time.Now().UTC().Truncate(0)
 	r0 := &record{ProductId: "foo", entry: entry{Price: json.Number("3.50"), Time: t0}}
 
-	err := w.writeRecord(r0)
+	err := w.writeRecord(r0, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -26,12 +26,17 @@ func TestBatchWriterContents(t *testing.T) {
 	fs.Lock()
 	fs.m[n0].Lock()
 
-	if len(fs.m[n0].ops) != 2 {
-		t.Error("should have had 2 ops events")
+	if len(fs.m[n0].ops) != 1 {
+		t.Fatal("should have had 1 op event")
+	}
+
+	data := fs.m[n0].ops[0].data
+	if data[len(data)-1] != '\n' {
+		t.Error("record should be newline terminated")
 	}
 
 	var rd record
-	err = json.Unmarshal([]byte(fs.m[n0].ops[1].data), &rd)
+	err = json.Unmarshal([]byte(data), &rd)
 
 	if err != nil {
 		t.Error(err)
@@ -44,7 +49,7 @@ func TestBatchWriterContents(t *testing.T) {
 
 func TestBatchWriterGrouping(t *testing.T) {
 	fs := newMemFS()
-	w := batchWriter{fs: fs}
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval}
 
 	t0 := time.Now().UTC().Truncate(0)
 	r0 := &record{ProductId: "foo", entry: entry{Price: json.Number("3.50"), Time: t0}}
@@ -52,7 +57,7 @@ func TestBatchWriterGrouping(t *testing.T) {
 	t1 := time.Now().UTC().Truncate(0)
 	r1 := &record{ProductId: "foo", entry: entry{Price: json.Number("2.20"), Time: t1}, PreviousPrice: r0.Price}
 
-	err := w.writeRecord(r0)
+	err := w.writeRecord(r0, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,13 +65,13 @@ func TestBatchWriterGrouping(t *testing.T) {
 	n0 := filepath.Join(ResultsSubdirectory, w.batch.filename.String())
 	fs.Lock()
 	fs.m[n0].Lock()
-	if len(fs.m[n0].ops) != 2 {
-		t.Error("should have had 2 ops events")
+	if len(fs.m[n0].ops) != 1 {
+		t.Error("should have had 1 op event")
 	}
 	fs.m[n0].Unlock()
 	fs.Unlock()
 
-	err = w.writeRecord(r1)
+	err = w.writeRecord(r1, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -82,8 +87,8 @@ func TestBatchWriterGrouping(t *testing.T) {
 		t.Error("old filename should no longer exist")
 	}
 	fs.m[n1].Lock()
-	if len(fs.m[n1].ops) != 4 {
-		t.Error("should have had 4 write events")
+	if len(fs.m[n1].ops) != 2 {
+		t.Error("should have had 2 write events")
 	}
 	fs.m[n1].Unlock()
 	fs.Unlock()
@@ -95,8 +100,8 @@ func TestBatchWriterGrouping(t *testing.T) {
 	fs.m[n1].Lock()
 	ops := fs.m[n1].ops
 
-	if len(ops) != 7 {
-		t.Error("should have had 7 total events")
+	if len(ops) != 4 {
+		t.Error("should have had 4 total events")
 	}
 
 	if ops[len(ops)-2].name != "sync" {
@@ -110,7 +115,7 @@ func TestBatchWriterGrouping(t *testing.T) {
 
 func TestBatchWriterMaxSize(t *testing.T) {
 	fs := newMemFS()
-	w := batchWriter{fs: fs}
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval}
 
 	var prevPrice json.Number
 	write := func(n int) {
@@ -118,14 +123,14 @@ func TestBatchWriterMaxSize(t *testing.T) {
 			p := json.Number(fmt.Sprint(i))
 			r := &record{ProductId: "foo", entry: entry{Price: p, Time: time.Now().UTC().Truncate(0)}, PreviousPrice: prevPrice}
 			prevPrice = p
-			err := w.writeRecord(r)
+			err := w.writeRecord(r, nil)
 			if err != nil {
 				t.Error(err)
 			}
 		}
 	}
 
-	if MaxRecordsPerFile < 3 {
+	if DefaultMaxRecordsPerFile < 3 {
 		panic("can't test batching with max size < 3")
 	}
 
@@ -142,11 +147,11 @@ func TestBatchWriterMaxSize(t *testing.T) {
 	default:
 	}
 
-	write(MaxRecordsPerFile)
+	write(DefaultMaxRecordsPerFile)
 
 	select {
 	case <-b1.synced:
-	case <-time.After(FlushInterval / 2):
+	case <-time.After(testFlushInterval / 2):
 		t.Error("first batch should have been synced")
 	}
 
@@ -157,13 +162,13 @@ func TestBatchWriterMaxSize(t *testing.T) {
 	select {
 	case <-b2.synced:
 		t.Error("second batch should not have been synced yet")
-	case <-time.After(FlushInterval / 2):
+	case <-time.After(testFlushInterval / 2):
 	}
 
-	write(MaxRecordsPerFile)
+	write(DefaultMaxRecordsPerFile)
 	select {
 	case <-b2.synced:
-	case <-time.After(FlushInterval / 2):
+	case <-time.After(testFlushInterval / 2):
 		t.Error("second batch should have been synced")
 	}
 
@@ -176,7 +181,7 @@ func TestBatchWriterMaxSize(t *testing.T) {
 	select {
 	case <-b3.synced:
 		t.Error("third batch should not have been synced yet")
-	case <-time.After(FlushInterval / 2):
+	case <-time.After(testFlushInterval / 2):
 	}
 
 	b4 := w.batch
@@ -186,8 +191,8 @@ func TestBatchWriterMaxSize(t *testing.T) {
 
 	select {
 	case <-b3.synced:
-	case <-time.After(FlushInterval):
-		t.Error("third batch should have been synced within FlushInterval")
+	case <-time.After(testFlushInterval):
+		t.Error("third batch should have been synced within the flush interval")
 	}
 
 	write(1)
@@ -198,7 +203,7 @@ func TestBatchWriterMaxSize(t *testing.T) {
 
 func TestBatchWriterMonotonicity(t *testing.T) {
 	fs := newMemFS()
-	w := batchWriter{fs: fs}
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval}
 
 	t0 := time.Now().UTC().Truncate(0)
 	t1 := time.Now().UTC().Truncate(0)
@@ -206,7 +211,7 @@ func TestBatchWriterMonotonicity(t *testing.T) {
 	r0 := &record{ProductId: "foo", entry: entry{Price: json.Number("3.50"), Time: t1}}
 	r1 := &record{ProductId: "foo", entry: entry{Price: json.Number("2.20"), Time: t0}, PreviousPrice: r0.Price}
 
-	err := w.writeRecord(r0)
+	err := w.writeRecord(r0, nil)
 
 	if err != nil {
 		t.Error(err)
@@ -217,7 +222,7 @@ func TestBatchWriterMonotonicity(t *testing.T) {
 	var panic interface{}
 	func() {
 		defer func() { panic = recover() }()
-		_ = w.writeRecord(r1)
+		_ = w.writeRecord(r1, nil)
 	}()
 
 	if panic == nil {
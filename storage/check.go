@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Report summarizes the outcome of a consistency check of a data directory
+type Report struct {
+	Files      int      // number of results files that were checked
+	Records    int64    // number of records that were parsed
+	Violations []error  // invariant violations that were found
+	Repairs    []string // repairs that were made (only when repairing)
+	Pending    []string // files still being written, or which need repair on startup
+}
+
+func (r *Report) violation(name string, format string, args ...interface{}) {
+	r.Violations = append(r.Violations, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+func (r *Report) repaired(name string, format string, args ...interface{}) {
+	r.Repairs = append(r.Repairs, fmt.Sprintf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+func (r *Report) pending(name string, format string, args ...interface{}) {
+	r.Pending = append(r.Pending, fmt.Sprintf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+// Check performs a full, read only scan of a data directory. In addition to
+// the invariants verified on startup, the contents of every file are parsed
+// to verify nRecords fields, the per product entrySeq numbers of every link,
+// record timestamps, and the chain of previousPrice values of every product.
+//
+// It is safe to run while the directory is being written to. The most
+// recent files may not have been finalized yet, so any problems with them are
+// reported as pending instead of as violations.
+func Check(fs readFS) (Report, error) {
+	c := checker{fs: fs, deep: true}
+	err := c.run()
+	return c.Report, err
+}
+
+// Repair makes the same repairs to a data directory as are made on startup,
+// finalizing any results files which were left unfinished by a crash, without
+// replaying the write ahead log. The directory is locked while repairing, so
+// it can't be used while the service is running.
+func Repair(ctx context.Context, path string) (Report, error) {
+	lock, err := lockDirectory(ctx, Options{Path: path})
+	if err != nil {
+		return Report{}, err
+	}
+	defer lock.release()
+
+	fs := osFS(path)
+	if err := recoverResults(fs); err != nil {
+		return Report{}, err
+	}
+
+	return checkConsistency(fs, true, "")
+}
+
+// checkConsistency verifies the invariants of the results directory:
+//   - every results file has a valid name
+//   - fileSeq numbers are contiguous
+//   - entrySeq numbers continue from one file to the next
+//   - start timestamps are monotonic
+//   - every file is linked once into the product directory of each of its
+//     productIds, i.e. its link count is nProductIds+1
+//
+// Files which don't have the expected link count were not finalized before a
+// crash, so they are re-parsed to verify the nRecords and nProductIds fields.
+// When repair is true, these fields are corrected by renaming the file, and
+// missing links are created.
+//
+// If resuming is not empty, it names the last results file, which will be
+// reopened for writing, so it's reported as pending and never repaired.
+func checkConsistency(fs fs, repair bool, resuming string) (Report, error) {
+	c := checker{fs: fs, resuming: resuming}
+	if repair {
+		c.repair = fs
+	}
+	err := c.run()
+	return c.Report, err
+}
+
+type checker struct {
+	fs     readFS
+	repair writeFS // nil if read only
+	deep   bool    // parse every file, not just unfinalized ones
+
+	// the product directories are being rebuilt, so missing links are
+	// expected and only reported as repairs
+	reindexing bool
+
+	// where the product directories are checked and linked into, if not
+	// ProductSubdirectory
+	products string
+
+	// number of violations that affect the names of links, i.e. those of
+	// the fileSeq, nRecords, nProductIds and start fields of results files
+	// and of the per product entrySeq derived from them
+	indexViolations int
+
+	resuming string // path of a file that is still being written
+
+	// per product state, only tracked for deep checks
+	productEntrySeqs map[string]int64
+	lastPrices       map[string]json.Number
+	links            map[string]struct{}
+
+	Report
+}
+
+type checkedFile struct {
+	path  string
+	links int
+	filename
+}
+
+func (c *checker) run() error {
+	names, err := c.fs.Sub(ResultsSubdirectory).Files()
+	if err != nil {
+		return err
+	}
+
+	if c.deep {
+		c.productEntrySeqs = make(map[string]int64)
+		c.lastPrices = make(map[string]json.Number)
+		c.links = make(map[string]struct{})
+	}
+
+	files := make([]*checkedFile, 0, len(names))
+	for _, name := range names {
+		c.Files++
+		cf := &checkedFile{path: filepath.Join(ResultsSubdirectory, name)}
+
+		if err := cf.parse(name); err != nil {
+			c.indexViolation(cf.path, "unparseable filename: %v", err)
+			files = append(files, nil)
+			continue
+		}
+
+		cf.links, err = c.fs.Links(cf.path)
+		if os.IsNotExist(err) && c.repair == nil {
+			// renamed by a concurrent writer after listing, so
+			// this and any subsequent files are still being written
+			c.pending(cf.path, "renamed while checking")
+			break
+		} else if err != nil {
+			return err
+		}
+
+		files = append(files, cf)
+	}
+
+	// when not repairing, files at the end that have not been fully
+	// linked are assumed to be still in progress
+	tail := len(files)
+	for tail > 0 && files[tail-1] != nil && files[tail-1].links >= 0 && files[tail-1].links < int(files[tail-1].nProductIds)+1 {
+		tail--
+	}
+
+	var prev *checkedFile
+	for i, cf := range files {
+		if cf == nil {
+			prev = nil
+			continue
+		}
+
+		pending := (c.repair == nil && i >= tail) || cf.path == c.resuming
+		if c.deep || cf.check() != nil || (cf.links >= 0 && cf.links != int(cf.nProductIds)+1) {
+			if err := c.checkFile(cf, pending); err != nil {
+				return err
+			}
+		}
+
+		if prev != nil {
+			c.checkSequence(cf.path, prev.filename, cf.filename)
+		}
+		prev = cf
+	}
+
+	if c.deep && prev != nil {
+		return c.checkProductDirectories(prev.fileSeq)
+	}
+
+	return nil
+}
+
+// indexViolation reports a violation that affects the names of links
+func (c *checker) indexViolation(name string, format string, args ...interface{}) {
+	c.indexViolations++
+	c.violation(name, format, args...)
+}
+
+func (c *checker) productDirectories() string {
+	if c.products == "" {
+		return ProductSubdirectory
+	}
+	return c.products
+}
+
+// checkSequence verifies the invariants between two consecutive files
+func (c *checker) checkSequence(name string, prev, f filename) {
+	if f.fileSeq != prev.fileSeq+1 {
+		c.indexViolation(name, "fileSeq %d does not follow %d", f.fileSeq, prev.fileSeq)
+	}
+	if f.entrySeq != prev.entrySeq+prev.nRecords {
+		c.violation(name, "entrySeq %d does not follow %d+%d", f.entrySeq, prev.entrySeq, prev.nRecords)
+	}
+	if f.start.Before(prev.start) {
+		c.indexViolation(name, "start time %v is before previous file's %v", f.start, prev.start)
+	}
+}
+
+// checkFile parses a results file and verifies its name and links against its
+// contents. When repairing, the file is renamed and linked as necessary, and
+// the checkedFile is updated accordingly.
+func (c *checker) checkFile(cf *checkedFile, pending bool) error {
+	// problems with files that are still being written are expected
+	problem := c.violation
+	if pending {
+		problem = func(name string, format string, args ...interface{}) {
+			c.pending(name, format, args...)
+		}
+	}
+
+	records, err := priceLoader{c.fs}.loadFile(c.fs, cf.path)
+	if os.IsNotExist(err) && pending {
+		c.pending(cf.path, "renamed while checking")
+		return nil
+	} else if err != nil {
+		c.indexViolation(cf.path, "unparseable contents: %v", err)
+		return nil
+	}
+
+	c.Records += int64(len(records))
+
+	if len(records) == 0 {
+		problem(cf.path, "no records")
+		return nil
+	}
+
+	if !records[0].entry.Time.Equal(cf.start) {
+		c.indexViolation(cf.path, "start time %v does not match first record's %v", cf.start, records[0].entry.Time)
+	}
+
+	// tally records per product in order of appearance, which is the same
+	// as the order used by batch.flush
+	var productIds []string
+	nRecords := make(map[string]int64)
+	for i, rec := range records {
+		if i > 0 && rec.entry.Time.Before(records[i-1].entry.Time) {
+			c.violation(cf.path, "record %d timestamp %v is before previous record's", i, rec.entry.Time)
+		}
+
+		if c.deep {
+			if rec.PreviousPrice != c.lastPrices[rec.ProductId] {
+				c.violation(cf.path, "record %d previousPrice %q of %q does not match last price %q", i, rec.PreviousPrice, rec.ProductId, c.lastPrices[rec.ProductId])
+			}
+			c.lastPrices[rec.ProductId] = rec.entry.Price
+		}
+
+		if _, exists := nRecords[rec.ProductId]; !exists {
+			productIds = append(productIds, rec.ProductId)
+		}
+		nRecords[rec.ProductId]++
+	}
+
+	if cf.nRecords != int64(len(records)) || cf.nProductIds != int64(len(productIds)) {
+		if c.repair == nil || pending {
+			problem(cf.path, "name has nRecords=%d nProductIds=%d but contents have %d and %d", cf.nRecords, cf.nProductIds, len(records), len(productIds))
+			if !pending {
+				c.indexViolations++
+			}
+		} else {
+			corrected := cf.filename
+			corrected.nRecords = int64(len(records))
+			corrected.nProductIds = int64(len(productIds))
+			correctedPath := filepath.Join(ResultsSubdirectory, corrected.String())
+
+			if err := c.repair.Rename(cf.path, correctedPath); err != nil {
+				return err
+			}
+			if err := c.repair.SyncDirectory(ResultsSubdirectory); err != nil {
+				return err
+			}
+			c.repaired(cf.path, "name had nRecords=%d nProductIds=%d, renamed to %s", cf.nRecords, cf.nProductIds, corrected.String())
+
+			cf.filename, cf.path = corrected, correctedPath
+		}
+	}
+
+	// when reindexing, files are still linked into the old product
+	// directories too
+	if cf.links > int(cf.nProductIds)+1 && !c.reindexing {
+		c.violation(cf.path, "%d links, expected %d", cf.links, cf.nProductIds+1)
+	}
+
+	for _, productId := range productIds {
+		entrySeq, linked, err := c.productEntrySeq(productId, cf.fileSeq)
+		if err != nil {
+			return err
+		}
+
+		productFilename := cf.filename
+		productFilename.nRecords = nRecords[productId]
+		productFilename.entrySeq = entrySeq
+		link := filepath.Join(c.productDirectories(), ProductIdHash(productId), productFilename.String())
+
+		if c.deep {
+			c.productEntrySeqs[productId] = entrySeq + nRecords[productId]
+			c.links[link] = struct{}{}
+
+			_, err := c.fs.Links(link)
+			if os.IsNotExist(err) {
+				linked = false
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if linked {
+			continue
+		}
+
+		if !c.reindexing {
+			problem(cf.path, "missing link %s", link)
+		}
+
+		if c.repair != nil && !pending {
+			if err := c.repair.Link(cf.path, link); err != nil {
+				return err
+			}
+			if err := c.repair.SyncDirectory(filepath.Dir(link)); err != nil {
+				return err
+			}
+			c.repaired(cf.path, "linked to %s", link)
+		}
+	}
+
+	return nil
+}
+
+// productEntrySeq computes the entrySeq that a product's file with a given
+// fileSeq should have, and whether or not that file is already linked.
+//
+// For deep checks this is tracked while scanning, otherwise it's computed from
+// the preceding files in the product directory.
+func (c *checker) productEntrySeq(productId string, fileSeq int64) (entrySeq int64, linked bool, err error) {
+	if c.deep {
+		if entrySeq = c.productEntrySeqs[productId]; entrySeq == 0 {
+			entrySeq = 1
+		}
+		return entrySeq, true, nil
+	}
+
+	files, err := c.fs.Sub(filepath.Join(c.productDirectories(), ProductIdHash(productId))).Files()
+	if err != nil {
+		return
+	}
+
+	entrySeq = 1
+	for _, name := range files {
+		var f filename
+		if err := f.FromString(name); err != nil {
+			continue
+		}
+
+		if f.fileSeq == fileSeq {
+			return f.entrySeq, true, nil
+		} else if f.fileSeq > fileSeq {
+			break
+		}
+
+		entrySeq = f.entrySeq + f.nRecords
+	}
+
+	return
+}
+
+// checkProductDirectories reports any files in the product directories that
+// don't correspond to a record in the results directory. Files with a fileSeq
+// past the last checked file may have been linked after the results directory
+// was listed, so they are ignored.
+func (c *checker) checkProductDirectories(lastFileSeq int64) error {
+	productDirectories := c.fs.Sub(c.productDirectories())
+
+	hashes, err := productDirectories.Files()
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		names, err := productDirectories.Sub(hash).Files()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			path := filepath.Join(c.productDirectories(), hash, name)
+
+			var f filename
+			if err := f.FromString(name); err != nil {
+				c.violation(path, "unparseable filename: %v", err)
+				continue
+			}
+
+			if _, exists := c.links[path]; !exists && f.fileSeq <= lastFileSeq {
+				c.violation(path, "does not match any results file")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	fs := newMemFS()
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval}
+
+	t0 := time.Now().UTC().Truncate(0)
+	err := w.writeRecord(&record{ProductId: "foo", entry: entry{Price: json.Number("3.50"), Time: t0}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := w.batch
+	w.closeBatch()
+	<-b.synced
+
+	report, err := checkConsistency(fs, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 1 || len(report.Violations) != 0 {
+		t.Error("finalized file should be consistent", report)
+	}
+
+	// simulate a crash after writing two records to a second file, but
+	// before the filename was updated or the file was linked
+	t1 := t0.Add(time.Second)
+	f := filename{fileSeq: 2, entrySeq: 2, nRecords: 1, nProductIds: 1, start: t1}
+	writeResultsFile(t, fs, f, ""+
+		`{"productId":"bar","newPrice":2.20,"timestamp":"`+t1.Format(time.RFC3339Nano)+`"}`+"\n"+
+		`{"productId":"foo","previousPrice":3.50,"newPrice":4.20,"timestamp":"`+t1.Format(time.RFC3339Nano)+`"}`+"\n")
+
+	report, err = checkConsistency(fs, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 0 || len(report.Pending) != 3 || len(report.Repairs) != 0 {
+		t.Error("stale filename and 2 missing links should be pending without repairing", report)
+	}
+
+	report, err = checkConsistency(fs, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repairs) != 3 {
+		t.Error("should have renamed the file and created 2 links", report)
+	}
+
+	report, err = checkConsistency(fs, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || len(report.Violations) != 0 {
+		t.Error("repaired directory should be consistent", report)
+	}
+
+	f.nRecords = 2
+	f.nProductIds = 2
+	if n, _ := fs.Links(filepath.Join(ResultsSubdirectory, f.String())); n != 3 {
+		t.Error("renamed file should be linked into both product directories", n)
+	}
+
+	f.entrySeq = 2
+	f.nRecords = 1
+	if _, err := fs.Open(filepath.Join(ProductSubdirectory, ProductIdHash("foo"), f.String())); err != nil {
+		t.Error("link for foo should continue its entrySeq", err)
+	}
+
+	f.entrySeq = 1
+	if _, err := fs.Open(filepath.Join(ProductSubdirectory, ProductIdHash("bar"), f.String())); err != nil {
+		t.Error("link for bar should start its entrySeq", err)
+	}
+
+	// a gap in the sequence numbers can only be reported
+	writeResultsFile(t, fs, filename{fileSeq: 4, entrySeq: 10, nRecords: 1, nProductIds: 1, start: t0}, "")
+	report, err = checkConsistency(fs, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 4 {
+		t.Error("should have reported fileSeq, entrySeq, and start time violations, and missing contents", report.Violations)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fs := newMemFS()
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval}
+
+	write := func(productId string, price, previousPrice json.Number) {
+		err := w.writeRecord(&record{ProductId: productId, PreviousPrice: previousPrice, entry: entry{Price: price, Time: time.Now().UTC().Truncate(0)}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flush := func() {
+		b := w.batch
+		w.closeBatch()
+		<-b.synced
+	}
+
+	write("foo", "3.50", "")
+	write("bar", "2.20", "")
+	flush()
+	write("foo", "4.20", "3.50")
+	flush()
+
+	report, err := Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || report.Records != 3 || len(report.Violations) != 0 || len(report.Pending) != 0 {
+		t.Error("finalized files should be consistent", report)
+	}
+
+	// a record still being written is pending
+	write("bar", "1.00", "2.20")
+	report, err = Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 0 || len(report.Pending) != 1 {
+		t.Error("unfinalized file should be pending", report)
+	}
+	flush()
+
+	// a broken previousPrice chain is a violation
+	write("foo", "5.00", "3.50")
+	last := w.batch.filename
+	flush()
+
+	// as is a stray file in a product directory
+	stray := filepath.Join(ProductSubdirectory, ProductIdHash("baz"), filename{fileSeq: 1, entrySeq: 1, nRecords: 1, nProductIds: 1}.String())
+	if err := fs.Link(filepath.Join(ResultsSubdirectory, last.String()), stray); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Violations) != 3 {
+		t.Error("should have reported previousPrice mismatch, stray link and bad link count", report.Violations)
+	}
+}
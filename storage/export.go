@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+// Export writes the records of a data directory to w as newline delimited
+// JSON, in the format of the results files, in the order they were written.
+// If productId is not empty only the records of that product are written.
+//
+// Like Check, it's safe to run while the directory is being written to. The
+// file that is still being written is exported up to its last complete
+// record.
+func Export(fs readFS, w io.Writer, productId string) (n int64, err error) {
+	d := fs.Sub(ResultsSubdirectory)
+	if productId != "" {
+		d = fs.Sub(filepath.Join(ProductSubdirectory, ProductIdHash(productId)))
+	}
+
+	files, err := d.Files()
+	if err != nil {
+		return 0, err
+	}
+
+	e := json.NewEncoder(w)
+	for i, name := range files {
+		records, err := priceLoader{d}.loadFile(d, name)
+		if os.IsNotExist(err) && i == len(files)-1 {
+			// renamed after listing, since it's still being written
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("reading %s: %w", name, err)
+		}
+
+		for _, rec := range records {
+			if productId != "" && rec.ProductId != productId {
+				continue
+			}
+			if err := e.Encode(rec); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Import writes the records read from r, in the format written by Export, to
+// a new data directory, which is locked while importing.
+//
+// The records must be in chronological order. Their previousPrice fields are
+// recomputed, so that a subset of an export can be imported. Records are
+// grouped into results files by their timestamps, the same way they would
+// have been had they been written by the service.
+func Import(ctx context.Context, opts Options, r io.Reader) (n int64, err error) {
+	opts = opts.withDefaults()
+
+	if err := os.MkdirAll(filepath.Join(opts.Path, ResultsSubdirectory), 0777); err != nil {
+		return 0, err
+	}
+
+	lock, err := lockDirectory(ctx, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.release()
+
+	return importRecords(osFS(opts.Path), opts, r)
+}
+
+func importRecords(fs fs, opts Options, r io.Reader) (n int64, err error) {
+	for _, subdirectory := range []string{ResultsSubdirectory, ProductSubdirectory, WALSubdirectory} {
+		if files, err := fs.Sub(subdirectory).Files(); err != nil {
+			return 0, err
+		} else if len(files) > 0 {
+			return 0, errors.New(errors.Invalid, "data directory is not empty")
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		failed error
+	)
+	w := &batchWriter{
+		fs: fs,
+		fail: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errors.Collect(&failed, err)
+		},
+		metrics:    newModelMetrics(opts.MaxRecordsPerFile),
+		maxRecords: opts.MaxRecordsPerFile,
+
+		// batches are closed based on the timestamps of the records,
+		// since the flush timer would fire immediately for records
+		// in the past
+		flushInterval: math.MaxInt64,
+	}
+	defer func() {
+		w.close()
+		errors.Collect(&err, failed)
+	}()
+
+	lastPrices := make(map[string]json.Number)
+	var last time.Time
+
+	d := json.NewDecoder(r)
+	for {
+		var rec record
+		if err := d.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, errors.Wrap(err, errors.Malformed, fmt.Sprintf("record %d", n+1))
+		}
+
+		if rec.ProductId == "" || rec.entry.Price == NullPrice || rec.entry.Time.IsZero() {
+			return n, errors.New(errors.Invalid, fmt.Sprintf("record %d: productId, newPrice and timestamp are required", n+1))
+		}
+		if rec.entry.Time.Before(last) {
+			return n, errors.New(errors.Invalid, fmt.Sprintf("record %d: timestamp %v is before previous record's", n+1, rec.entry.Time))
+		}
+		last = rec.entry.Time
+
+		rec.PreviousPrice = lastPrices[rec.ProductId]
+		lastPrices[rec.ProductId] = rec.entry.Price
+
+		if w.batch != nil && rec.entry.Time.Sub(w.batch.start) >= opts.FlushInterval {
+			w.closeBatch()
+		}
+		if err := w.writeRecord(&rec, nil); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
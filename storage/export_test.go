@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+func TestExportImport(t *testing.T) {
+	t0 := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	line := func(productId, price string, offset time.Duration) string {
+		return `{"productId":"` + productId + `","newPrice":` + price + `,"timestamp":"` + t0.Add(offset).Format(time.RFC3339Nano) + `"}` + "\n"
+	}
+
+	// previousPrice is recomputed, so it can be omitted or wrong
+	input := line("foo", "3.50", 0) +
+		line("bar", "2.20", 0) +
+		line("foo", "4.20", time.Millisecond) +
+		strings.Replace(line("bar", "1.00", time.Minute), `"newPrice"`, `"previousPrice":9.99,"newPrice"`, 1)
+
+	fs := newMemFS()
+	opts := Options{MaxRecordsPerFile: 2, FlushInterval: time.Second}.withDefaults()
+	n, err := importRecords(fs, opts, strings.NewReader(input))
+	if err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+
+	report, err := Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 3 || report.Records != 4 || len(report.Violations) != 0 || len(report.Pending) != 0 {
+		t.Error("imported records should be consistent, split by size and time", report)
+	}
+
+	var out bytes.Buffer
+	if n, err := Export(fs, &out, ""); err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+	var records []record
+	d := json.NewDecoder(&out)
+	for d.More() {
+		var rec record
+		if err := d.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 4 || records[2].PreviousPrice != "3.50" || records[3].PreviousPrice != "2.20" || !records[3].entry.Time.Equal(t0.Add(time.Minute)) {
+		t.Error("exported records should match the import, with previous prices", records)
+	}
+
+	out.Reset()
+	if n, err := Export(fs, &out, "bar"); err != nil || n != 2 || strings.Contains(out.String(), "foo") {
+		t.Error("only the product's records should be exported", n, err, out.String())
+	}
+
+	if _, err := importRecords(fs, opts, strings.NewReader(input)); errors.CodeOf(err) != errors.Invalid {
+		t.Error("importing into a data directory that isn't empty should be rejected", err)
+	}
+
+	unordered := line("foo", "3.50", time.Second) + line("foo", "4.20", 0)
+	if _, err := importRecords(newMemFS(), opts, strings.NewReader(unordered)); errors.CodeOf(err) != errors.Invalid {
+		t.Error("records out of order should be rejected", err)
+	}
+
+	if _, err := importRecords(newMemFS(), opts, strings.NewReader(line("foo", "3.50", 0)+"{")); errors.CodeOf(err) != errors.Malformed {
+		t.Error("malformed records should be rejected", err)
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+const (
+	retryAttempts = 5
+	retryDelay    = 10 * time.Millisecond
+)
+
+// failure latches the first persistence error. Once an error has been
+// latched the model is considered degraded and stops accepting writes, since
+// they can no longer be guaranteed to reach the disk.
+type failure struct {
+	report func(error) // called with every error, must be safe for concurrent use
+
+	once     sync.Once
+	err      error
+	degraded chan struct{}
+}
+
+func newFailure(report func(error)) *failure {
+	if report == nil {
+		report = func(error) {}
+	}
+
+	return &failure{report: report, degraded: make(chan struct{})}
+}
+
+// fail reports an error and latches the degraded state
+func (f *failure) fail(err error) {
+	f.report(err)
+	f.once.Do(func() {
+		f.err = err
+		close(f.degraded)
+	})
+}
+
+// check returns an Unavailable error wrapping the latched error, if any
+func (f *failure) check() error {
+	select {
+	case <-f.degraded:
+		return errors.Wrap(f.err, errors.Unavailable, "persistent storage degraded")
+	default:
+		return nil
+	}
+}
+
+// retry calls op until it succeeds, returns an error that isn't transient,
+// or the attempts are exhausted, backing off exponentially in between
+func retry(op func() error) (err error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil || attempt == retryAttempts || !transient(err) {
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// transient reports whether an error returned by the filesystem is likely to
+// go away if the operation is reattempted (e.g. EINTR, EAGAIN, EMFILE)
+func transient(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && errno.Temporary()
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+type failingRecordWriter struct{ err error }
+
+func (w failingRecordWriter) writeRecord(*record, func(error)) error { return w.err }
+func (failingRecordWriter) close()                                   {}
+
+func TestLinearizerDegraded(t *testing.T) {
+	ctx := context.Background()
+	reported := make(chan error, 10)
+	mem := simpleMap{"mem", t, make(map[string]entry)}
+
+	model := linearizeUpdates(mem, noop{}, failingRecordWriter{fmt.Errorf("disk on fire")}, newFailure(func(err error) { reported <- err }), nil, nil, DefaultWriteQueueLength)
+
+	err := model.UpdatePrice(ctx, "foo", json.Number("3.50"))
+	if err != nil {
+		t.Error("first update should have been accepted", err)
+	}
+
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("write error should have been reported")
+	}
+
+	err = model.UpdatePrice(ctx, "foo", json.Number("2.20"))
+	if _, ok := err.(interface{ Temporary() bool }); !ok {
+		t.Error("updates should be rejected with a temporary error once degraded", err)
+	}
+}
+
+// syncFailingFS wraps a memFS so that syncing any file fails
+type syncFailingFS struct{ *memFS }
+
+type syncFailingFile struct{ appendFile }
+
+func (fs syncFailingFS) New(name string) (appendFile, error) {
+	f, err := fs.memFS.New(name)
+	return syncFailingFile{f}, err
+}
+
+func (syncFailingFile) Sync() error { return syscall.EIO }
+
+func TestBatchFlushFailure(t *testing.T) {
+	fs := syncFailingFS{newMemFS()}
+	reported := make(chan error, 10)
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: testFlushInterval, fail: func(err error) { reported <- err }}
+
+	err := w.writeRecord(&record{ProductId: "foo", entry: entry{Price: json.Number("3.50"), Time: time.Now()}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := w.batch
+	w.closeBatch()
+	<-b.synced
+
+	select {
+	case err := <-reported:
+		if b.err == nil || err != b.err {
+			t.Error("sync error should have been recorded and reported", err, b.err)
+		}
+	default:
+		t.Fatal("sync error should have been reported")
+	}
+
+	files, _ := fs.Sub(filepath.Join(ProductSubdirectory, ProductIdHash("foo"))).Files()
+	if len(files) != 0 {
+		t.Error("file should not have been linked after failing to sync")
+	}
+}
+
+// dirSyncFailingFS wraps a memFS so that syncing any directory fails
+type dirSyncFailingFS struct{ *memFS }
+
+func (dirSyncFailingFS) SyncDirectory(string) error { return syscall.EIO }
+
+func TestWALDirectorySyncFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, dirSyncFailingFS{newMemFS()}, testOptions)
+	defer model.Close()
+
+	if err := model.UpdatePrice(ctx, "foo", "3.50"); err == nil {
+		t.Error("update should not be acknowledged when the WAL segment's name can't be synced")
+	}
+}
+
+// writeFailingFS wraps a memFS so that writing to files created while failing
+// is set fails
+type writeFailingFS struct {
+	*memFS
+	failing *bool
+}
+
+type writeFailingFile struct{ appendFile }
+
+func (fs writeFailingFS) New(name string) (appendFile, error) {
+	f, err := fs.memFS.New(name)
+	if *fs.failing {
+		f = writeFailingFile{f}
+	}
+	return f, err
+}
+
+func (writeFailingFile) Write([]byte) (int, error) { return 0, syscall.EIO }
+
+func TestProductEntrySeqAfterWriteFailure(t *testing.T) {
+	failing := true
+	fs := writeFailingFS{newMemFS(), &failing}
+	w := batchWriter{fs: fs, maxRecords: DefaultMaxRecordsPerFile, flushInterval: time.Minute, fail: func(error) {}}
+	defer w.close()
+
+	now := time.Now()
+	if err := w.writeRecord(&record{ProductId: "foo", entry: entry{Price: "1.00", Time: now}}, nil); err == nil {
+		t.Fatal("write should have failed")
+	}
+
+	failing = false
+	if err := w.writeRecord(&record{ProductId: "foo", entry: entry{Price: "2.00", Time: now}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b := w.batch
+	w.closeBatch()
+	<-b.synced
+
+	files, _ := fs.Sub(filepath.Join(ProductSubdirectory, ProductIdHash("foo"))).Files()
+	var f filename
+	if len(files) != 1 || f.FromString(files[0]) != nil || f.entrySeq != 1 {
+		t.Error("a failed write should not use up the product's entrySeq", files)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := retry(func() error {
+		attempts++
+		if attempts < 3 {
+			return syscall.EINTR
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Error("transient errors should be retried", err, attempts)
+	}
+
+	attempts = 0
+	err = retry(func() error {
+		attempts++
+		return syscall.EIO
+	})
+	if err != syscall.EIO || attempts != 1 {
+		t.Error("permanent errors should not be retried", err, attempts)
+	}
+}
+
+func TestModelOnError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reported := make(chan error, 10)
+	opts := testOptions
+	opts.OnError = func(err error) { reported <- err }
+
+	model := mustNewFromFS(t, ctx, syncFailingFS{newMemFS()}, opts)
+	defer model.Close()
+
+	if _, _, err := model.UpdatePriceDurable(ctx, "foo", "3.50"); err == nil {
+		t.Fatal("durable update should fail when the file can't be synced")
+	}
+
+	select {
+	case err := <-reported:
+		if !errors.Is(err, syscall.EIO) {
+			t.Error("sync error should be passed to OnError", err)
+		}
+	default:
+		t.Fatal("sync error should be passed to OnError")
+	}
+}
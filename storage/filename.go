@@ -48,6 +48,15 @@ func (f filename) String() string {
 }
 
 func (f *filename) FromString(s string) (err error) {
+	if err = f.parse(s); err != nil {
+		return &errors.Error{Code: errors.Corrupt, Path: s, Message: "unparseable filename", Err: err}
+	}
+
+	return f.check()
+}
+
+// parse decodes the fields of a filename without checking their validity
+func (f *filename) parse(s string) (err error) {
 	b, err := hex.DecodeString(strings.TrimSuffix(s, ".json"))
 	if err != nil {
 		return err
@@ -64,32 +73,27 @@ func (f *filename) FromString(s string) (err error) {
 	errors.Collect(&err, binary.Read(r, binary.BigEndian, &nanoSec))
 	f.start = time.Unix(unixSec, nanoSec)
 
-	return f.check()
-}
-
-type fieldError struct {
-	name  string
-	value int64
+	return
 }
 
-func (e fieldError) Error() string {
-	return fmt.Sprintf("invalid %s %d", e.name, e.value)
+func fieldError(name string, value int64) error {
+	return &errors.Error{Code: errors.Corrupt, Path: name, Message: fmt.Sprintf("invalid value %d", value)}
 }
 
 func (f filename) check() (err error) {
 	// TODO version bit?
 
 	if f.fileSeq < 1 {
-		errors.Collect(&err, fieldError{"fileSeq", f.fileSeq})
+		errors.Collect(&err, fieldError("fileSeq", f.fileSeq))
 	}
 	if f.entrySeq < 1 {
-		errors.Collect(&err, fieldError{"entrySeq", f.entrySeq})
+		errors.Collect(&err, fieldError("entrySeq", f.entrySeq))
 	}
 	if f.nRecords < 1 {
-		errors.Collect(&err, fieldError{"nRecords", f.nRecords})
+		errors.Collect(&err, fieldError("nRecords", f.nRecords))
 	}
 	if f.nProductIds < 1 {
-		errors.Collect(&err, fieldError{"nProductIds", f.nProductIds})
+		errors.Collect(&err, fieldError("nProductIds", f.nProductIds))
 	}
 
 	return
@@ -3,6 +3,8 @@ package storage
 import (
 	"testing"
 	"time"
+
+	"github.com/nothingmuch/repricer/errors"
 )
 
 func TestFilenameCheck(t *testing.T) {
@@ -10,6 +12,12 @@ func TestFilenameCheck(t *testing.T) {
 
 	if err := f.check(); err == nil {
 		t.Error("blank filename should be invalid")
+	} else if errors.CodeOf(err) != errors.Corrupt {
+		t.Error("invalid filename should be corrupt", err)
+	}
+
+	if err := f.FromString("not hex.json"); errors.CodeOf(err) != errors.Corrupt {
+		t.Error("unparseable filename should be corrupt", err)
 	}
 
 	f.fileSeq = 1
@@ -11,9 +11,13 @@ type fs interface {
 }
 
 type writeFS interface {
-	New(string) (appendFile, error) // O_WRONLY|O_APPEND|O_CREAT|O_EXCL
+	New(string) (appendFile, error)    // O_WRONLY|O_APPEND|O_CREAT|O_EXCL
+	Append(string) (appendFile, error) // O_WRONLY|O_APPEND
 	Link(string, string) error
 	Rename(string, string) error
+	Truncate(string, int64) error
+	Remove(string) error
+	SyncDirectory(string) error // makes renames and links in a directory durable
 }
 
 type appendFile interface {
@@ -26,5 +30,6 @@ type readFile io.Reader
 type readFS interface {
 	Open(string) (readFile, error) // readonly
 	Files() ([]string, error)      // in lexicographical order
+	Links(string) (int, error)     // number of hard links to a file
 	Sub(string) readFS             // TODO generalize to Sub(string) fs? it's only really important for filescanning
 }
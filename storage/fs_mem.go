@@ -3,9 +3,11 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -65,8 +67,53 @@ func (m *memFS) Rename(old, new string) error {
 	m.Lock()
 	defer m.Unlock()
 
-	m.m[new] = m.m[old]
-	delete(m.m, old)
+	if file, exists := m.m[old]; exists {
+		m.m[new] = file
+		delete(m.m, old)
+		return nil
+	}
+
+	// directories are implicit, so renaming one renames all of its files
+	prefix := old + string(filepath.Separator)
+	renamed := false
+	for name, file := range m.m {
+		if strings.HasPrefix(name, prefix) {
+			m.m[filepath.Join(new, name[len(prefix):])] = file
+			delete(m.m, name)
+			renamed = true
+		}
+	}
+	if !renamed {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *memFS) Truncate(name string, size int64) error {
+	m.Lock()
+	file, exists := m.m[name]
+	m.Unlock()
+	if !exists {
+		return fmt.Errorf("no such file")
+	}
+
+	file.log(fileOp{"truncate", strconv.FormatInt(size, 10)})
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, exists := m.m[name]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+
+	delete(m.m, name)
+	return nil
+}
+
+func (m *memFS) SyncDirectory(name string) error {
 	return nil
 }
 
@@ -83,12 +130,24 @@ func (m *memFS) New(name string) (appendFile, error) {
 	return f, nil
 }
 
+func (m *memFS) Append(name string) (appendFile, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	f, exists := m.m[name]
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return f, nil
+}
+
 func (m *memFS) Open(name string) (readFile, error) {
 	m.Lock()
 	file, exists := m.m[name]
 	m.Unlock()
 	if !exists {
-		return nil, fmt.Errorf("no such file")
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 	}
 
 	var buf bytes.Buffer
@@ -100,6 +159,11 @@ func (m *memFS) Open(name string) (readFile, error) {
 		switch op.name {
 		case "write":
 			buf.WriteString(op.data)
+		case "truncate":
+			size, _ := strconv.Atoi(op.data)
+			if size < buf.Len() {
+				buf.Truncate(size)
+			}
 		default:
 		}
 	}
@@ -107,17 +171,48 @@ func (m *memFS) Open(name string) (readFile, error) {
 	return &buf, nil
 }
 
+func (m *memFS) Links(name string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	file, exists := m.m[name]
+	if !exists {
+		return 0, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+
+	n := 0
+	for _, f := range m.m {
+		if f == file {
+			n++
+		}
+	}
+	return n, nil
+}
+
 func (m *memFS) Files() ([]string, error) {
 	files, err := m.allFiles()
-	basenames := make([]string, 0, len(files))
+	return children(files), err
+}
+
+// children returns the distinct first path components of a list of names,
+// so that subdirectories are listed just like they are by osFS
+func children(names []string) []string {
+	seen := make(map[string]struct{}, len(names))
+	ret := make([]string, 0, len(names))
 
-	for _, name := range files {
-		if strings.IndexByte(name, filepath.Separator) == -1 {
-			basenames = append(basenames, name)
+	for _, name := range names {
+		if i := strings.IndexByte(name, filepath.Separator); i != -1 {
+			name = name[:i]
+		}
+
+		if _, exists := seen[name]; !exists {
+			seen[name] = struct{}{}
+			ret = append(ret, name)
 		}
 	}
 
-	return basenames, err
+	sort.Strings(ret)
+	return ret
 }
 
 func (m *memFS) allFiles() ([]string, error) {
@@ -140,11 +235,17 @@ func (src *memFS) clone() *memFS {
 	src.Lock()
 	defer src.Unlock()
 
+	// preserve hard links by copying each file only once
+	copies := make(map[*memFile]*memFile, len(src.m))
+
 	dst := newMemFS()
 	for key, value := range src.m {
-		value.Lock()
-		dst.m[key] = &memFile{ops: append([]fileOp{}, value.ops...)}
-		value.Unlock()
+		if _, exists := copies[value]; !exists {
+			value.Lock()
+			copies[value] = &memFile{ops: append([]fileOp{}, value.ops...)}
+			value.Unlock()
+		}
+		dst.m[key] = copies[value]
 	}
 	return dst
 }
@@ -162,6 +263,10 @@ func (s subMemFS) Open(name string) (readFile, error) {
 	return s.inner.Open(path.Join(s.prefix, name))
 }
 
+func (s subMemFS) Links(name string) (int, error) {
+	return s.inner.Links(path.Join(s.prefix, name))
+}
+
 func (s subMemFS) Files() ([]string, error) {
 	files, err := s.inner.allFiles()
 	start := sort.SearchStrings(files, s.prefix+string(filepath.Separator))
@@ -174,5 +279,5 @@ func (s subMemFS) Files() ([]string, error) {
 		files[i] = v[len(s.prefix)+1:]
 	}
 
-	return files, err
+	return children(files), err
 }
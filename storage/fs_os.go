@@ -34,6 +34,28 @@ func (base osFS) Rename(old, new string) error {
 	return os.Rename(base.filename(old), base.filename(new))
 }
 
+func (base osFS) Truncate(name string, size int64) error {
+	return os.Truncate(base.filename(name), size)
+}
+
+func (base osFS) Remove(name string) error {
+	return os.Remove(base.filename(name))
+}
+
+func (base osFS) SyncDirectory(name string) error {
+	f, err := os.Open(base.filename(name))
+	if err != nil {
+		return err
+	}
+
+	if err := syncDirectory(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
 func (base osFS) New(name string) (appendFile, error) {
 	target := base.filename(name)
 
@@ -49,6 +71,14 @@ func (base osFS) New(name string) (appendFile, error) {
 	}
 }
 
+func (base osFS) Append(name string) (appendFile, error) {
+	if f, err := os.OpenFile(base.filename(name), os.O_APPEND|os.O_WRONLY, 0); f != nil {
+		return f, err
+	} else {
+		return nil, err
+	}
+}
+
 func (base osFS) Open(name string) (readFile, error) {
 	if f, err := os.Open(base.filename(name)); f != nil {
 		return f, err
@@ -57,6 +87,15 @@ func (base osFS) Open(name string) (readFile, error) {
 	}
 }
 
+func (base osFS) Links(name string) (int, error) {
+	info, err := os.Stat(base.filename(name))
+	if err != nil {
+		return 0, err
+	}
+
+	return linkCount(info), nil
+}
+
 func (base osFS) Files() ([]string, error) {
 	f, err := os.Open(string(base))
 	if err != nil {
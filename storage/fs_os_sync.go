@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+)
+
+func syncDirectory(f *os.File) error {
+	return f.Sync()
+}
@@ -120,6 +120,72 @@ var tests = []struct {
 			t.Error("contents of file were not preserved")
 		}
 	}},
+	{"truncate", func(t *testing.T, fs fs) {
+		w, _ := fs.New("foo")
+		_, _ = w.Write([]byte("first\nsec"))
+		_ = w.Close()
+
+		err := fs.Truncate("foo", int64(len("first\n")))
+		if err != nil {
+			t.Error(err)
+		}
+
+		r, err := fs.Open("foo")
+		if err != nil || r == nil {
+			t.Fatal("truncated file should have been opened successfully", err)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != "first\n" {
+			t.Error("file should have been truncated", string(b))
+		}
+	}},
+	{"append", func(t *testing.T, fs fs) {
+		if w, err := fs.Append("foo"); err == nil || w != nil {
+			t.Error("appending to a non existent file should fail", err, w)
+		}
+
+		w, _ := fs.New("foo")
+		_, _ = w.Write([]byte("first\n"))
+		_ = w.Close()
+
+		w, err := fs.Append("foo")
+		if err != nil || w == nil {
+			t.Fatal("existing file should have been opened successfully", err)
+		}
+		_, _ = w.Write([]byte("second\n"))
+		_ = w.Close()
+
+		r, err := fs.Open("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != "first\nsecond\n" {
+			t.Error("appended data should follow existing contents", string(b))
+		}
+	}},
+	{"remove", func(t *testing.T, fs fs) {
+		w, _ := fs.New("foo")
+		_ = w.Close()
+
+		err := fs.Remove("foo")
+		if err != nil {
+			t.Error(err)
+		}
+
+		files, _ := fs.Files()
+		if len(files) != 0 {
+			t.Error("removed file should no longer be in the list")
+		}
+
+		if err := fs.Remove("foo"); err == nil {
+			t.Error("removing a non existent file should fail")
+		}
+	}},
 
 	// TODO
 	// filenames with slashes in them
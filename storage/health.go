@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// writableCheckInterval is how long the outcome of a writability check is
+// reused, so that frequent probes don't each create and sync a file
+const writableCheckInterval = 5 * time.Second
+
+// Health describes the state of a storage model, for liveness and readiness
+// probes
+type Health struct {
+	Running  bool      `json:"running"`  // the linearizer and writer goroutines are running
+	Stalled  bool      `json:"stalled"`  // records are queued but none were written for Options.StallTimeout
+	LastSync time.Time `json:"lastSync"` // when a record was last synced, zero if none since startup
+
+	Queued        int `json:"queued"`        // number of records waiting to be written
+	QueueCapacity int `json:"queueCapacity"` // number of records that can be queued
+
+	Writable      bool   `json:"writable"`
+	WritableError string `json:"writableError,omitempty"` // why the data directory isn't writable
+	Degraded      string `json:"degraded,omitempty"`      // the persistence error that stopped updates
+
+	Startup StartupStatus `json:"startup"`
+}
+
+// StartupStatus summarizes the recovery of the data directory on startup
+type StartupStatus struct {
+	Violations int  `json:"violations"` // inconsistencies found by the startup check
+	Repairs    int  `json:"repairs"`    // repairs made by the startup check
+	Replayed   int  `json:"replayed"`   // records replayed from the write ahead log
+	Resumed    bool `json:"resumed"`    // whether the last results file was reopened
+}
+
+// Alive reports whether the model can make progress. A degraded model never
+// recovers, so it needs to be restarted.
+func (h Health) Alive() bool { return h.Running && !h.Stalled && h.Degraded == "" }
+
+// Ready reports whether the model can accept updates. A full write queue is
+// not a reason to stop routing requests to it, since those updates are
+// rejected with a temporary error while reads are still served.
+func (h Health) Ready() bool { return h.Alive() && h.Writable }
+
+// health reports the state of the linearizer and writer goroutines. The
+// writer is stalled if no queued records were written for stallTimeout.
+func (l linearizedState) health(stallTimeout time.Duration) (h Health) {
+	select {
+	case <-l.stopped:
+	case <-l.done:
+	default:
+		h.Running = true
+	}
+
+	h.Queued = len(l.newPriceRecords) + len(l.writeQueue)
+	h.QueueCapacity = cap(l.newPriceRecords) + cap(l.writeQueue)
+
+	l.activity.Lock()
+	h.LastSync = l.activity.lastSync
+	h.Stalled = h.Queued > 0 && time.Since(l.activity.lastWrite) > stallTimeout
+	l.activity.Unlock()
+
+	if err := l.check(); err != nil {
+		h.Degraded = err.Error()
+	}
+
+	return
+}
+
+// writableCache remembers the outcome of the last writability check
+type writableCache struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// check returns the outcome of checkWritable, which is only repeated if the
+// last one is older than writableCheckInterval
+func (c *writableCache) check(fs writeFS) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.checked.IsZero() || time.Since(c.checked) > writableCheckInterval {
+		c.err = checkWritable(fs)
+		c.checked = time.Now()
+	}
+
+	return c.err
+}
+
+// checkWritable verifies that files can be created in the data directory
+func checkWritable(fs writeFS) error {
+	name := filepath.Join(TemporarySubdirectory, fmt.Sprintf("healthcheck-%d", time.Now().UnixNano()))
+
+	f, err := fs.New(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fs.Remove(name) }()
+
+	if _, err := f.Write([]byte("ok\n")); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	fs := newMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, fs, testOptions)
+
+	if _, _, err := model.UpdatePriceDurable(ctx, "foo", "1.00"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := model.Health()
+	if !h.Alive() || !h.Ready() || !h.Writable || h.LastSync.IsZero() {
+		t.Error("new model should be healthy", h)
+	}
+
+	if h.QueueCapacity != DefaultWriteQueueLength {
+		t.Error("unexpected queue capacity", h.QueueCapacity)
+	}
+
+	if files, _ := fs.Sub(TemporarySubdirectory).Files(); len(files) != 0 {
+		t.Error("writability check should not leave files behind", files)
+	}
+
+	_ = model.Close()
+
+	if h := model.Health(); h.Alive() || h.Ready() {
+		t.Error("closed model should not be alive", h)
+	}
+}
+
+func TestReadyWithFullQueue(t *testing.T) {
+	h := Health{Running: true, Writable: true, Queued: 50, QueueCapacity: 50}
+	if !h.Ready() {
+		t.Error("a full write queue should apply back-pressure to writes, not make the model unready")
+	}
+}
+
+func TestWritableCache(t *testing.T) {
+	var c writableCache
+
+	if err := c.check(newMemFS()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.check(syncFailingFS{newMemFS()}); err != nil {
+		t.Error("a recent outcome should be reused", err)
+	}
+
+	c.checked = time.Now().Add(-2 * writableCheckInterval)
+	if err := c.check(syncFailingFS{newMemFS()}); err == nil {
+		t.Error("an outdated outcome should be checked again")
+	}
+}
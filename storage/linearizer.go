@@ -1,53 +1,123 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
-const WriteQueueLength = 50
-
-type Log interface{ Log(...interface{}) }
-
 // linearizedState is stacks an a partial in memory priceModel on top of a read
 // only snapshot, to manage consistent population of `previousPrice` in records
 // before being written to storage
 //
 // construct with linearizeUpdates()
 type linearizedState struct {
-	mem priceReader
+	mem    priceReader
+	synced *syncedStore // prices of records which have been synced
+	wal    *wal         // may be nil
+	log    *logging.Logger
+
+	*failure
+	*lifecycle
+	activity *activity
 
 	newPriceRecords   chan *record
+	writeQueue        chan chan *record
 	lastPriceRequests chan lastPriceRequest
 }
 
+// lifecycle tracks the shutdown of the linearizer's goroutines
+type lifecycle struct {
+	sync.RWMutex
+	closing bool // guards sending on newPriceRecords, which is closed on shutdown
+
+	stopped chan struct{} // closed when the linearizer loop exits
+	done    chan struct{} // closed when all accepted records have been persisted
+}
+
+// activity tracks the progress of the writer, for health checks and
+// backpressure
+type activity struct {
+	// number of LastPrice calls waiting for the linearizer loop to receive
+	// their request, accessed atomically. it's first so that it's aligned
+	// for atomic access on 32 bit platforms.
+	pendingReads int64
+
+	sync.Mutex
+	lastWrite time.Time     // when a record was last passed to persistent storage
+	lastSync  time.Time     // when a record was last synced
+	perRecord time.Duration // moving average of the time taken to write a record
+}
+
+// weight of the latest observation in the moving average of perRecord
+const activitySmoothing = 0.1
+
+// wrote notes that a record was written, which took the given duration from
+// when the writer started waiting for it to be finalized
+func (a *activity) wrote(took time.Duration) {
+	a.Lock()
+	a.lastWrite = time.Now()
+	if a.perRecord == 0 {
+		a.perRecord = took
+	} else {
+		a.perRecord += time.Duration(activitySmoothing * float64(took-a.perRecord))
+	}
+	a.Unlock()
+}
+
+func (a *activity) synced() {
+	a.Lock()
+	a.lastSync = time.Now()
+	a.Unlock()
+}
+
 var _ priceModel = linearizedState{}
 
 // linearizeUpdates will, given:
 // - `mem`, a priceModel used synchronously (ideally nonblocking) TODO interface with LoadOrStore semantics
 // - `snapshot`, a priceReader used async defining initial last prices state
 // - `persistent`, a sink for finalized price records
+// - `failed`, which latches write errors from `persistent`
+// - `log`, an optional write ahead log for records before they're finalized
+// - `logger`, used for errors not attributable to a request, may be nil
+// - `queueLength`, the number of records that may be waiting to be written
 // returns a priceModel which will:
 // - provides a RW view that shadows/overlays `mem` on top of `snapshot`
+// - provides a read only view of synced records on top of `snapshot`
 // - fill in consistent `previousPrice` values for updates and output to `persistent`
-func linearizeUpdates(mem priceState, snapshot priceReader, persistent recordWriter) priceModel {
-	// WriteQueueLength is split between two buffered channels: // TODO expose len() as metric
-	newPriceRecords := make(chan *record, WriteQueueLength/2) // avoid failing nonblocking UpdatePrice() calls due to minor contention
-	writeQueue := make(chan chan *record, WriteQueueLength/2) // avoid avoid blocking linearizer loop due to write contention pending previousPrice
+// - reject updates once `failed` has latched an error
+func linearizeUpdates(mem priceState, snapshot priceReader, persistent recordWriter, failed *failure, log *wal, logger *logging.Logger, queueLength int) linearizedState {
+	// queueLength is split between two buffered channels:
+	newPriceRecords := make(chan *record, queueLength/2)                    // avoid failing nonblocking UpdatePrice() calls due to minor contention
+	writeQueue := make(chan chan *record, queueLength-cap(newPriceRecords)) // avoid avoid blocking linearizer loop due to write contention pending previousPrice
 
 	// no need to buffer read requests
-	lastPriceRequests := make(chan lastPriceRequest) // TODO expose len() as metric
+	lastPriceRequests := make(chan lastPriceRequest)
 
 	// capture channels needed for implementing model interface as member variables
 	l := linearizedState{
-		mem:               mem,
+		mem:     mem,
+		synced:  newSyncedStore(snapshot),
+		wal:     log,
+		log:     logger,
+		failure: failed,
+		lifecycle: &lifecycle{
+			stopped: make(chan struct{}),
+			done:    make(chan struct{}),
+		},
+		activity:          &activity{lastWrite: time.Now()},
 		newPriceRecords:   newPriceRecords,
+		writeQueue:        writeQueue,
 		lastPriceRequests: lastPriceRequests,
 	}
 
-	// TODO capture errors from both loop goroutines
 	go l.flushWrites(persistent, writeQueue)
 	go l.linearizeOperations(mem, snapshot, writeQueue, newPriceRecords, lastPriceRequests)
 
@@ -55,30 +125,69 @@ func linearizeUpdates(mem priceState, snapshot priceReader, persistent recordWri
 }
 
 // this loop waits for records to be finalized and then passes them on to
-// persistent storage.
-func (linearizedState) flushWrites(persistent recordWriter, writeQueue <-chan chan *record) {
+// persistent storage. when the write queue is closed, it waits for the
+// records to be synced before signalling that the model is done.
+func (l linearizedState) flushWrites(persistent recordWriter, writeQueue <-chan chan *record) {
+	defer close(l.done)
+	defer l.wal.close() // the linearizer has stopped appending
+	defer persistent.close()
+
 	// process the write queue in order
 	for c := range writeQueue {
+		start := time.Now()
+
 		// wait for individual records
 		rec := <-c
 
-		// perform a blocking write
-		_ = persistent.writeRecord(rec)
+		// once degraded, records that were already accepted can't be
+		// written without risking the consistency of the storage
+		// directory, so they're discarded
+		if err := l.check(); err != nil {
+			rec.log.Error("discarding accepted record", "product_id", rec.ProductId, "timestamp", rec.entry.Time, "error", err)
+			l.fail(fmt.Errorf("discarding record of %q at %v: %w", rec.ProductId, rec.entry.Time, err))
+			if rec.durable != nil {
+				rec.durable <- err
+			}
+			continue
+		}
 
-		// TODO
-		// - handle errors from writer
-		// - pass chan struct{} to propagate notification of file sync
+		// once synced, make the record visible to durable reads before
+		// notifying any durable update of the outcome, so that its
+		// writes can be read back
+		synced := func(err error) {
+			if err == nil {
+				l.activity.synced()
+				l.synced.SetPriceIfNewer(rec.ProductId, rec.entry.Price, rec.entry.Time)
+				l.wal.synced(rec.walSegment)
+			}
+			if rec.durable != nil {
+				rec.durable <- err
+			}
+		}
+
+		// perform a blocking write
+		err := persistent.writeRecord(rec, synced)
+		l.activity.wrote(time.Since(start))
+		if err != nil {
+			err = fmt.Errorf("writing record of %q at %v: %w", rec.ProductId, rec.entry.Time, err)
+			l.fail(err)
+			if rec.durable != nil {
+				rec.durable <- err
+			}
+		}
 	}
 }
 
 type lastPriceRequest struct {
 	productId string
 	result    chan entry
+	log       *logging.Logger
 }
 
 type prevPriceRequest struct {
 	productId string
 	result    chan json.Number
+	log       *logging.Logger // of the request which caused the snapshot read
 }
 
 // this loop linearizes all operations to create a total ordering of state
@@ -93,7 +202,10 @@ type prevPriceRequest struct {
 // during this interval the underlying struct is considered to be owned by the
 // linearizer goroutine, which will make mutations to it, and should not be
 // accessed by other goroutines
-func (linearizedState) linearizeOperations(
+//
+// once newPriceRecords is closed and no snapshot reads are pending, the loop
+// closes writeQueue and exits.
+func (l linearizedState) linearizeOperations(
 	mem priceState,
 	snapshot priceReader,
 	writeQueue chan<- chan *record,
@@ -107,17 +219,31 @@ func (linearizedState) linearizeOperations(
 	// internal channels for mananging in ongoing snapshot read requests
 	// these are buffered so that they never cause the loop to block to
 	// avoid needing to spawn additional goroutines
-	prevPriceLoaded := make(chan *record, WriteQueueLength+1)
-	prevPriceRequests := make(chan prevPriceRequest, WriteQueueLength+1)
+	queueLength := cap(l.newPriceRecords) + cap(l.writeQueue)
+	prevPriceLoaded := make(chan *record, queueLength+1)
+	prevPriceRequests := make(chan prevPriceRequest, queueLength+1)
+
+	defer close(l.stopped)
+
+	var lastTime time.Time
 
 	for {
-		// case <-ctx.Cancel:
-		// TODO handle shutdown?
+		// when shutting down, pending snapshot reads must still be
+		// processed since records may be waiting for previousPrice
+		if newPriceRecords == nil && len(prevPriceRequests) == 0 && len(prevPriceListener) == 0 {
+			close(writeQueue)
+			return
+		}
+
 		select {
 		case req := <-lastPriceRequests: // FIXME how do these get created
 			// start an inconsistent reads operation, returns latest
 			// price from memory, disk or new reprice requests
-			if price, time, _ := mem.LastPrice(req.productId); price != NullPrice { // TODO handle error
+			price, time, err := mem.LastPrice(req.productId)
+			if err != nil {
+				req.log.Error("reading price from memory", "product_id", req.productId, "error", err)
+			}
+			if price != NullPrice {
 				// this is not redundant with mem.LastPrice outside of this
 				// goroutine because other writes may have been
 				// processed by this time
@@ -130,11 +256,11 @@ func (linearizedState) linearizeOperations(
 				// request
 
 				// since prevPriceRequests is buffered, and
-				// there can never be more than WriteQueueLength
+				// there can never be more than queueLength
 				// requests, this channel write will not block,
 				// but if this ever changes this may deadlock
 				// and will need to be wrapped in a new goro
-				prevPriceRequests <- prevPriceRequest{req.productId, make(chan json.Number, 1)}
+				prevPriceRequests <- prevPriceRequest{req.productId, make(chan json.Number, 1), req.log}
 
 				// no cancellation context is necessary
 				// because if this last price request is
@@ -202,7 +328,13 @@ func (linearizedState) linearizeOperations(
 			// perform the blocking read in a new goroutine
 			go func() {
 				prevRec := &record{ProductId: req.productId}
-				prevRec.entry.Price, prevRec.entry.Time, _ = snapshot.LastPrice(req.productId) // TODO handle errors
+				var err error
+				prevRec.entry.Price, prevRec.entry.Time, err = snapshot.LastPrice(req.productId)
+				if err != nil {
+					// FIXME the product is treated as if it had
+					// no previous price
+					req.log.Error("reading price from snapshot", "product_id", req.productId, "error", err)
+				}
 				// log.Log("read", *prevRec, "from snapshot")
 
 				// results can be made available immediately
@@ -226,7 +358,9 @@ func (linearizedState) linearizeOperations(
 			// because all writes are serialized by this goroutine
 			// but sync.Map already provides LoadOrStore so we use
 			// IfMissing variant
-			_ = mem.SetPriceIfMissing(prevRec.ProductId, prevRec.entry.Price, prevRec.entry.Time) // TODO handle errors
+			if err := mem.SetPriceIfMissing(prevRec.ProductId, prevRec.entry.Price, prevRec.entry.Time); err != nil {
+				l.log.Error("storing snapshot price in memory", "product_id", prevRec.ProductId, "error", err)
+			}
 
 			// remove listener, the result has already been written
 			// to it in the background goroutine
@@ -239,29 +373,54 @@ func (linearizedState) linearizeOperations(
 				resultChan <- prevRec.entry
 			}
 			delete(lastPriceListeners, prevRec.ProductId)
-		case rec := <-newPriceRecords:
-			// assign the canonical timestamp for a given reprice event
+		case rec, ok := <-newPriceRecords:
+			if !ok {
+				// stop selecting on the closed channel
+				newPriceRecords = nil
+				continue
+			}
+
+			// assign the canonical timestamp for a given reprice event,
+			// unless it's being replayed from the WAL
 			// this assumes the OS clock is monotonic
 			// FIXME preserve monotonic clock data to maintain
 			// storage invariants on systems with a clock that can
 			// go backwards
-			rec.entry.Time = time.Now()
+			if rec.entry.Time.IsZero() {
+				rec.entry.Time = time.Now()
+
+				// timestamps must be strictly increasing so
+				// that replayed records can be identified
+				if !rec.entry.Time.After(lastTime) {
+					rec.entry.Time = lastTime.Add(time.Nanosecond)
+				}
+			}
+			lastTime = rec.entry.Time
 			// log.Log("assigned time", rec.entry.Time)
 
+			// log the record so that it survives a crash, the
+			// append is acknowledged asynchronously once synced
+			rec.walSegment = l.wal.append(rec)
+
 			// when the entry has a `previousValue` set it can be
 			// written to persistent storage, signalled by `finalized`
 			result := make(chan *record, 1)
 
 			// store the new price in memory but first preserve any
 			// previous value already in memory
-			hasPrice := mem.HasPrice(rec.ProductId)             // FIXME remove
-			previousPrice, _, _ := mem.LastPrice(rec.ProductId) // TODO handle errors
+			hasPrice := mem.HasPrice(rec.ProductId) // FIXME remove
+			previousPrice, _, err := mem.LastPrice(rec.ProductId)
+			if err != nil {
+				rec.log.Error("reading price from memory", "product_id", rec.ProductId, "error", err)
+			}
 
 			// log.Log("memory has prev price?", hasPrice, previousPrice)
 
-			// TODO for consistent `price` endpoint reads, this write
-			// needs to be delayed until sync
-			_ = mem.SetPrice(rec.ProductId, rec.entry.Price, rec.entry.Time)
+			// this write is visible to LastPrice immediately, consistent
+			// reads are served by LastDurablePrice once synced
+			if err := mem.SetPrice(rec.ProductId, rec.entry.Price, rec.entry.Time); err != nil {
+				rec.log.Error("storing price in memory", "product_id", rec.ProductId, "error", err)
+			}
 
 			// finalize the `previousPrice` field
 			if hasPrice { // TODO snapshot null prices are written back to memory, use them
@@ -285,10 +444,8 @@ func (linearizedState) linearizeOperations(
 					// requests that are waiting for that data
 					// that a more recent price is available
 					for _, result := range lastPriceListeners[rec.ProductId] {
-						// TODO for consistent `price` endpoint
-						// reads, this needs to be deferred
-						// until the data is written (or synced)
-						// to disk
+						// these are inconsistent reads, consistent
+						// ones use LastDurablePrice instead
 						result <- rec.entry // this should never block
 					}
 					delete(lastPriceListeners, rec.ProductId)
@@ -296,7 +453,7 @@ func (linearizedState) linearizeOperations(
 					// log.Log("making previous price request")
 					// no load operation in progress, start one
 					prevPriceResult = make(chan json.Number, 1)
-					prevPriceRequests <- prevPriceRequest{rec.ProductId, prevPriceResult}
+					prevPriceRequests <- prevPriceRequest{rec.ProductId, prevPriceResult, rec.log}
 				}
 
 				// in either case, wait for the price data
@@ -314,16 +471,21 @@ func (linearizedState) linearizeOperations(
 			// due to backpressure from write loop
 			writeQueue <- result
 
-			// TODO make(chan struct{}) and associate with *record
-			// to track syncs for managing consistent reads
 		}
 	}
 }
 
-func (l linearizedState) HasPrice(productId string) bool { return false } // FIXME remove by LastPrice(string) (*Entry, error)
+// logger returns the request scoped logger carried by ctx, falling back to the
+// model's logger
+func (l linearizedState) logger(ctx context.Context) *logging.Logger {
+	if log := logging.FromContext(ctx); log != nil {
+		return log
+	}
+	return l.log
+}
 
 // LastPrice provides the last known price of a given product (including non-durable state)
-func (l linearizedState) LastPrice(productId string) (json.Number, time.Time, error) {
+func (l linearizedState) LastPrice(ctx context.Context, productId string) (json.Number, time.Time, error) {
 	// since productReader interface is concurrency safe, we first try to
 	// satisfy a read from memory
 	if price, time, err := l.mem.LastPrice(productId); price != NullPrice || err != nil {
@@ -332,26 +494,156 @@ func (l linearizedState) LastPrice(productId string) (json.Number, time.Time, er
 
 	// on miss, add a request to be handled by the linearizer loop
 	result := make(chan entry, 1)
-	l.lastPriceRequests <- lastPriceRequest{productId, result}
+	atomic.AddInt64(&l.activity.pendingReads, 1)
+	select {
+	case l.lastPriceRequests <- lastPriceRequest{productId, result, l.logger(ctx)}:
+		atomic.AddInt64(&l.activity.pendingReads, -1)
+	case <-l.stopped:
+		atomic.AddInt64(&l.activity.pendingReads, -1)
+		return NullPrice, time.Time{}, errors.Temporary("shutting down")
+	}
 
 	// wait for request to be satisfied
 	ent := <-result
 	return ent.Price, ent.Time, nil
 }
 
+// LastDurablePrice provides the last price of a given product whose record has
+// been synced to disk. Unlike LastPrice, this will never return a price which
+// may be lost in a crash.
+func (l linearizedState) LastDurablePrice(ctx context.Context, productId string) (json.Number, time.Time, error) {
+	return l.synced.LastPrice(productId)
+}
+
 // UpdatePrice updates in memory price and queus a record for writing when processed.
 //
-// This implementation is non-blocking and will return an error when no writes
-// can be accepted.
-func (l linearizedState) UpdatePrice(productId string, price json.Number) error {
+// It returns an error immediately when no writes can be accepted, and otherwise
+// blocks only until the record has been synced to the write ahead log (in a
+// group commit with any other concurrent updates). When the write queue is
+// full, the error is errors.Overloaded, unless ctx has a deadline, in which case
+// it waits for the queue to drain until then.
+func (l linearizedState) UpdatePrice(ctx context.Context, productId string, price json.Number) error {
+	logged := make(chan error, 1)
+	err := l.enqueue(ctx, &record{
+		ProductId:  productId,
+		entry:      entry{Price: price},
+		Provenance: provenance.FromContext(ctx),
+		logged:     logged,
+		log:        l.logger(ctx),
+	})
+	if err != nil {
+		return err
+	}
+
+	// wait until the record is in the write ahead log
+	return <-logged
+}
+
+// replay queues a record from the write ahead log with its original
+// timestamp, and waits for it to be logged again. It blocks instead of
+// failing when the queue is full, and must only be called before any other
+// updates.
+func (l linearizedState) replay(rec record) error {
+	logged := make(chan error, 1)
+	rec.logged = logged
+	rec.PreviousPrice = NullPrice
+	rec.log = l.log
+	l.newPriceRecords <- &rec
+	return <-logged
+}
+
+// UpdatePriceDurable updates the price like UpdatePrice, but also waits until
+// the record has been synced to disk, and returns its finalized previousPrice
+// and timestamp.
+//
+// If ctx is done before the record is synced an error is returned, but the
+// update is still processed. Like UpdatePrice, it only waits for the write
+// queue to drain if ctx has a deadline.
+func (l linearizedState) UpdatePriceDurable(ctx context.Context, productId string, price json.Number) (json.Number, time.Time, error) {
+	durable := make(chan error, 1)
+	rec := &record{
+		ProductId:  productId,
+		entry:      entry{Price: price},
+		Provenance: provenance.FromContext(ctx),
+		durable:    durable,
+		log:        l.logger(ctx),
+	}
+
+	if err := l.enqueue(ctx, rec); err != nil {
+		return NullPrice, time.Time{}, err
+	}
+
 	select {
-	case l.newPriceRecords <- &record{
-		ProductId: productId,
-		entry:     entry{Price: price},
-	}:
+	case err := <-durable:
+		if err != nil {
+			return NullPrice, time.Time{}, err
+		}
+		return rec.PreviousPrice, rec.entry.Time, nil
+	case <-ctx.Done():
+		return NullPrice, time.Time{}, ctx.Err()
+	}
+}
+
+// enqueue submits a new record to the linearizer. If the write queue is full
+// it only blocks if ctx has a deadline, until the record is accepted, ctx is
+// done, or the model is degraded.
+func (l linearizedState) enqueue(ctx context.Context, rec *record) error {
+	if err := l.check(); err != nil {
+		return err
+	}
+
+	// hold a read lock to prevent the channel from being closed while
+	// sending to it
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.closing {
+		return errors.Temporary("shutting down")
+	}
+
+	select {
+	case l.newPriceRecords <- rec:
 		return nil
 	default:
-		// TODO add a blocking writer for completeness?
-		return errors.Temporary("write capacity exceeded")
 	}
+
+	// the read lock delays Close by at most the time remaining until the
+	// deadline
+	if _, ok := ctx.Deadline(); ok {
+		select {
+		case l.newPriceRecords <- rec:
+			return nil
+		case <-l.degraded:
+			return l.check()
+		case <-ctx.Done():
+		}
+	}
+
+	return errors.Overloaded{Reason: "write capacity exceeded", Delay: l.retryAfter()}
+}
+
+// retryAfter estimates how long it will take for the currently queued records
+// to be written, based on the recent throughput of the writer
+func (l linearizedState) retryAfter() time.Duration {
+	queued := len(l.newPriceRecords) + len(l.writeQueue)
+
+	l.activity.Lock()
+	defer l.activity.Unlock()
+
+	return time.Duration(queued) * l.activity.perRecord
+}
+
+// Close stops accepting updates, and waits for all previously accepted updates
+// to be written and synced. It returns an error if any of them could not be
+// persisted. Reads from memory remain available after closing.
+func (l linearizedState) Close() error {
+	l.Lock()
+	if !l.closing {
+		l.closing = true
+		close(l.newPriceRecords)
+	}
+	l.Unlock()
+
+	<-l.done
+	return l.check()
 }
@@ -1,21 +1,28 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
 )
 
 // unit test linearization of state only?
 // or entire storage component?
 
 func TestLinearizerSanity(t *testing.T) {
+	ctx := context.Background()
 	writes := make(chanRecordWriter, 1)
 	mem := simpleMap{"mem", t, make(map[string]entry)}
 
-	model := linearizeUpdates(mem, noop{}, writes)
+	model := linearizeUpdates(mem, noop{}, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
 
-	price, timestamp, err := model.LastPrice("foo")
+	price, timestamp, err := model.LastPrice(ctx, "foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -24,14 +31,14 @@ func TestLinearizerSanity(t *testing.T) {
 	}
 
 	t.Log("setting foo")
-	err = model.UpdatePrice("foo", json.Number("3.50"))
+	err = model.UpdatePrice(ctx, "foo", json.Number("3.50"))
 	if err != nil {
 		t.Error(err)
 	}
 
 	<-writes
 
-	price0, t0, err := model.LastPrice("foo")
+	price0, t0, err := model.LastPrice(ctx, "foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -41,13 +48,14 @@ func TestLinearizerSanity(t *testing.T) {
 }
 
 func TestLinearizerUpdateSanity(t *testing.T) {
+	ctx := context.Background()
 	writes := make(chanRecordWriter, 1)
 	mem := simpleMap{"mem", t, make(map[string]entry)}
 
-	model := linearizeUpdates(mem, noop{}, writes)
+	model := linearizeUpdates(mem, noop{}, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
 
 	t.Log("setting foo")
-	err := model.UpdatePrice("foo", json.Number("3.50"))
+	err := model.UpdatePrice(ctx, "foo", json.Number("3.50"))
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,7 +65,7 @@ func TestLinearizerUpdateSanity(t *testing.T) {
 		t.Error("written price should have been that of input")
 	}
 
-	price0, t0, err := model.LastPrice("foo")
+	price0, t0, err := model.LastPrice(ctx, "foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -66,7 +74,7 @@ func TestLinearizerUpdateSanity(t *testing.T) {
 	}
 
 	t.Log("updating foo")
-	err = model.UpdatePrice("foo", json.Number("2.20"))
+	err = model.UpdatePrice(ctx, "foo", json.Number("2.20"))
 	if err != nil {
 		t.Error(err)
 	}
@@ -76,7 +84,7 @@ func TestLinearizerUpdateSanity(t *testing.T) {
 		t.Error("written price should have been that of input")
 	}
 
-	price, t1, err := model.LastPrice("foo")
+	price, t1, err := model.LastPrice(ctx, "foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -92,6 +100,7 @@ func TestLinearizerUpdateSanity(t *testing.T) {
 }
 
 func TestLinearizerPriorData(t *testing.T) {
+	ctx := context.Background()
 	writes := make(chanRecordWriter, 1)
 	mem := simpleMap{" mem", t, make(map[string]entry)}
 	snap := simpleMap{"snap", t, make(map[string]entry)}
@@ -102,9 +111,9 @@ func TestLinearizerPriorData(t *testing.T) {
 
 	_ = snap.SetPrice("foo", json.Number("4.20"), t0)
 
-	model := linearizeUpdates(mem, snap, writes)
+	model := linearizeUpdates(mem, snap, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
 
-	price, t1, err := model.LastPrice("foo")
+	price, t1, err := model.LastPrice(ctx, "foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -113,14 +122,14 @@ func TestLinearizerPriorData(t *testing.T) {
 	}
 
 	t.Log("setting foo")
-	err = model.UpdatePrice("foo", json.Number("3.50"))
+	err = model.UpdatePrice(ctx, "foo", json.Number("3.50"))
 	if err != nil {
 		t.Error(err)
 	}
 
 	<-writes
 
-	price0, t2, err := model.LastPrice("foo")
+	price0, t2, err := model.LastPrice(ctx, "foo")
 	if err != nil {
 		t.Error(err)
 	}
@@ -129,7 +138,104 @@ func TestLinearizerPriorData(t *testing.T) {
 	}
 }
 
+func TestLinearizerDurableRead(t *testing.T) {
+	ctx := context.Background()
+	writes := make(unsyncedRecordWriter, 1)
+	mem := simpleMap{" mem", t, make(map[string]entry)}
+	snap := simpleMap{"snap", t, make(map[string]entry)}
+
+	t0 := time.Now().UTC().Truncate(0)
+	_ = snap.SetPrice("foo", json.Number("4.20"), t0)
+
+	model := linearizeUpdates(mem, snap, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
+
+	err := model.UpdatePrice(ctx, "foo", json.Number("3.50"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	synced := <-writes
+
+	if price, _, _ := model.LastPrice(ctx, "foo"); price != json.Number("3.50") {
+		t.Error("should have gotten unsynced data from inconsistent read")
+	}
+
+	price, t1, err := model.LastDurablePrice(ctx, "foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if price != json.Number("4.20") || !t1.Equal(t0) {
+		t.Error("should have gotten snapshot data from durable read before sync")
+	}
+
+	synced(nil)
+
+	if price, _, _ := model.LastDurablePrice(ctx, "foo"); price != json.Number("3.50") {
+		t.Error("should have gotten synced data from durable read")
+	}
+}
+
+func TestLinearizerBackpressure(t *testing.T) {
+	ctx := context.Background()
+	writes := make(unsyncedRecordWriter)
+	mem := simpleMap{" mem", t, make(map[string]entry)}
+
+	model := linearizeUpdates(mem, noop{}, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
+
+	// measure the throughput of the writer
+	if err := model.UpdatePrice(ctx, "foo", json.Number("1.00")); err != nil {
+		t.Fatal(err)
+	}
+	(<-writes)(nil)
+
+	// with the writer blocked, fill up the queue. accepted updates block
+	// until the linearizer can process them
+	for h := model.health(DefaultStallTimeout); h.Queued < h.QueueCapacity; h = model.health(DefaultStallTimeout) {
+		go func() { _ = model.UpdatePrice(ctx, "foo", json.Number("2.00")) }()
+		time.Sleep(time.Millisecond)
+	}
+
+	err := model.UpdatePrice(ctx, "foo", json.Number("2.00"))
+	overloaded, ok := err.(errors.Overloaded)
+	if !ok || overloaded.Delay <= 0 {
+		t.Fatal("updates should be rejected with a retry hint once the queue is full", err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, ok := model.UpdatePrice(waitCtx, "foo", json.Number("3.00")).(errors.Overloaded); !ok {
+		t.Error("updates should be rejected if the queue doesn't drain before the deadline")
+	}
+
+	waitCtx, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- model.UpdatePrice(waitCtx, "foo", json.Number("4.00")) }()
+
+	for {
+		select {
+		case synced := <-writes:
+			synced(nil)
+			continue
+		case err := <-done:
+			if err != nil {
+				t.Error("updates should wait for the queue to drain until the deadline", err)
+			}
+		}
+		break
+	}
+
+	go func() {
+		for synced := range writes {
+			synced(nil)
+		}
+	}()
+	_ = model.Close()
+	close(writes)
+}
+
 func TestLinearizerConcurrentRead(t *testing.T) {
+	ctx := context.Background()
 	writes := make(chanRecordWriter, 1)
 	mem := simpleMap{" mem", t, make(map[string]entry)}
 	snap := simpleMap{"snap", t, make(map[string]entry)}
@@ -138,12 +244,12 @@ func TestLinearizerConcurrentRead(t *testing.T) {
 	t0 := time.Now()
 	_ = snap.SetPrice("foo", json.Number("4.20"), t0)
 
-	model := linearizeUpdates(mem, syncReader{snap, release}, writes)
+	model := linearizeUpdates(mem, syncReader{snap, release}, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
 
 	lastPriceChan := make(chan entry)
 
 	go func() {
-		price, t1, err := model.LastPrice("foo")
+		price, t1, err := model.LastPrice(ctx, "foo")
 		if err != nil {
 			t.Error(err)
 		}
@@ -158,7 +264,7 @@ func TestLinearizerConcurrentRead(t *testing.T) {
 	release <- struct{}{}
 
 	go func() {
-		err := model.UpdatePrice("foo", json.Number("3.50"))
+		err := model.UpdatePrice(ctx, "foo", json.Number("3.50"))
 		if err != nil {
 			t.Error(err)
 		}
@@ -174,7 +280,7 @@ func TestLinearizerConcurrentRead(t *testing.T) {
 		}
 
 		t1 = ent.Time
-	case <-time.After(2 * FlushInterval):
+	case <-time.After(2 * testFlushInterval):
 		t.Fatal("timed out waiting for last price response")
 	}
 
@@ -195,7 +301,7 @@ func TestLinearizerConcurrentRead(t *testing.T) {
 		if rec.PreviousPrice != json.Number("4.20") {
 			t.Error("record should have previousPrice from snapshot")
 		}
-	case <-time.After(2 * FlushInterval):
+	case <-time.After(2 * testFlushInterval):
 		t.Fatal("timed out waiting for write")
 	}
 
@@ -203,7 +309,7 @@ func TestLinearizerConcurrentRead(t *testing.T) {
 	// released again
 	c := make(chan struct{})
 	go func() {
-		price0, t2, err := model.LastPrice("foo")
+		price0, t2, err := model.LastPrice(ctx, "foo")
 		if err != nil {
 			t.Error(err)
 		}
@@ -215,11 +321,33 @@ func TestLinearizerConcurrentRead(t *testing.T) {
 
 	select {
 	case <-c:
-	case <-time.After(2 * FlushInterval):
+	case <-time.After(2 * testFlushInterval):
 		t.Fatal("timed out waiting for in memory read")
 	}
 }
 
+func TestLinearizerSnapshotError(t *testing.T) {
+	writes := make(chanRecordWriter, 1)
+	mem := simpleMap{"mem", t, make(map[string]entry)}
+
+	model := linearizeUpdates(mem, failingReader{fmt.Errorf("disk on fire")}, writes, newFailure(nil), nil, nil, DefaultWriteQueueLength)
+
+	var buf bytes.Buffer
+	ctx := logging.NewContext(context.Background(), logging.New(&buf, logging.Info).With("request_id", "abc123"))
+
+	if price, _, _ := model.LastPrice(ctx, "foo"); price != NullPrice {
+		t.Error("failed snapshot read should not return a price", price)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal("snapshot read error should have been logged", err, buf.String())
+	}
+	if entry["error"] != "disk on fire" || entry["request_id"] != "abc123" {
+		t.Error("snapshot read error should be logged with the request's logger", entry)
+	}
+}
+
 /*
 t0   - get last price foo - in memory miss
 t0+e - last price from disk - 3.50@t-3
@@ -273,11 +401,26 @@ func (m simpleMap) HasPrice(productId string) (ret bool) {
 
 type chanRecordWriter chan *record
 
-func (c chanRecordWriter) writeRecord(r *record) error {
+func (c chanRecordWriter) writeRecord(r *record, synced func(error)) error {
 	c <- r
+	if synced != nil {
+		synced(nil)
+	}
+	return nil
+}
+
+func (c chanRecordWriter) close() {}
+
+// unsyncedRecordWriter passes on the sync callback of every record written
+type unsyncedRecordWriter chan func(error)
+
+func (c unsyncedRecordWriter) writeRecord(r *record, synced func(error)) error {
+	c <- synced
 	return nil
 }
 
+func (c unsyncedRecordWriter) close() {}
+
 type syncReader struct {
 	priceReader
 	wait chan struct{}
@@ -287,3 +430,10 @@ func (r syncReader) LastPrice(productId string) (json.Number, time.Time, error)
 	r.wait <- <-r.wait // pass token
 	return r.priceReader.LastPrice(productId)
 }
+
+type failingReader struct{ err error }
+
+func (failingReader) HasPrice(string) bool { return false }
+func (r failingReader) LastPrice(string) (json.Number, time.Time, error) {
+	return NullPrice, time.Time{}, r.err
+}
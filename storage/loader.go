@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 	"time"
 
 	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
 // priceLoader provides a priceReader interface from a readerFS
@@ -43,6 +50,7 @@ func (s priceLoader) LastPrice(productId string) (p json.Number, t time.Time, er
 }
 
 func (s priceLoader) PriceLog(
+	ctx context.Context,
 	productId string,
 	startTime, endTime time.Time,
 	offset int64, limit int,
@@ -52,9 +60,10 @@ func (s priceLoader) PriceLog(
 		// but there's still some bikeshedding to do, and the question
 		// of the extendedPriceModel and whether or not most most
 		// modeltypes should implement it or not
-		ProductId string
-		Price     json.Number
-		Timestamp time.Time
+		ProductId  string
+		Price      json.Number
+		Timestamp  time.Time
+		Provenance provenance.Provenance
 	},
 	err error,
 ) {
@@ -105,7 +114,11 @@ func (s priceLoader) PriceLog(
 		// open file to get t0-entrySeq (seq of first record in time interval)
 		//
 		// target entrySeq = time-GLB.entrySeq + n + offset
-		records, _ := s.loadFile(d, files[skipFiles]) // TODO error
+		records, loadErr := s.loadFile(d, files[skipFiles])
+		if loadErr != nil {
+			// the offset is counted from the start of the file instead
+			logging.FromContext(ctx).Warn("reading first file of interval", "file", files[skipFiles], "error", loadErr)
+		}
 		var offsetInFile int
 		for i, rec := range records {
 			if rec.entry.Time.After(startTime) {
@@ -148,16 +161,12 @@ func (s priceLoader) PriceLog(
 
 		records, loadErr := s.loadFile(d, filename)
 		if loadErr != nil {
-			// TODO handle parse errors (partly written data)
-			// since the last written file is potentially not yet
-			// valid JSON we can try to re-parse it appending ']',
-			// but a better way is to just change the on disk format
-			// to NDJSON, especially if combined with length
-			// constraints that ensure that records are smaller than
-			// the filesystem block size so as to prevent partial
-			// records from being written.
-			// for now just ignore errors if this is the last file.
-			if i != len(files)-1 {
+			// the last file may still be open for writing, in which
+			// case it's renamed after every record to update the
+			// nRecords field, so it can disappear between listing
+			// and opening. partial records are already ignored
+			// by loadFile, so only this race is tolerated.
+			if i != len(files)-1 || !os.IsNotExist(loadErr) {
 				errors.Collect(&err, loadErr)
 			}
 			continue
@@ -182,13 +191,15 @@ func (s priceLoader) PriceLog(
 			}
 
 			ret = append(ret, struct {
-				ProductId string
-				Price     json.Number
-				Timestamp time.Time
+				ProductId  string
+				Price      json.Number
+				Timestamp  time.Time
+				Provenance provenance.Provenance
 			}{
-				ProductId: rec.ProductId,
-				Price:     rec.entry.Price,
-				Timestamp: rec.entry.Time,
+				ProductId:  rec.ProductId,
+				Price:      rec.entry.Price,
+				Timestamp:  rec.entry.Time,
+				Provenance: rec.Provenance,
 			})
 
 			if len(ret) == limit {
@@ -206,6 +217,41 @@ func (s priceLoader) loadFile(d readFS, filename string) (r []record, err error)
 		return
 	}
 
-	err = json.NewDecoder(f).Decode(&r)
-	return
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+
+	return decodeRecords(data)
+}
+
+// decodeRecords parses the contents of a results file.
+//
+// Files are written as newline delimited JSON, but files written by earlier
+// versions contain a single JSON array, which is still supported for reading.
+func decodeRecords(data []byte) (r []record, err error) {
+	if isLegacyFormat(data) {
+		err = json.Unmarshal(data, &r)
+		return
+	}
+
+	// ignore any trailing partial line, it's either still being written or
+	// was left over by a crash and will be truncated on startup
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var rec record
+		if err = d.Decode(&rec); err == io.EOF {
+			return r, nil
+		} else if err != nil {
+			return
+		}
+		r = append(r, rec)
+	}
+}
+
+func isLegacyFormat(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '['
 }
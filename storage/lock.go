@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LockFile is the name of the file in the data directory which is locked by
+// the process writing to it
+const LockFile = "lock"
+
+// ErrLocked is returned when the data directory is already locked by another
+// process, and the caller did not ask to wait for it
+var ErrLocked = fmt.Errorf("data directory is locked by another process")
+
+// dirLock is an exclusive advisory lock on a data directory, which prevents
+// multiple processes from writing to it and corrupting sequence numbers
+type dirLock struct {
+	file *os.File
+	once sync.Once
+}
+
+// lockDirectory acquires the lock of the data directory opts.Path. If
+// opts.Standby is true and the lock is held by another process, it retries
+// every opts.LockPollInterval until the lock is released or ctx is done.
+func lockDirectory(ctx context.Context, opts Options) (*dirLock, error) {
+	opts = opts.withDefaults()
+
+	f, err := os.OpenFile(filepath.Join(opts.Path, LockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := tryLock(f)
+		if err == nil {
+			break
+		} else if err != errWouldBlock {
+			_ = f.Close()
+			return nil, fmt.Errorf("locking %s: %w", f.Name(), err)
+		} else if !opts.Standby {
+			_ = f.Close()
+			return nil, ErrLocked
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(opts.LockPollInterval):
+		}
+	}
+
+	// record the owner to aid debugging, this is not relied on
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return &dirLock{file: f}, nil
+}
+
+// release unlocks the data directory, it's safe to call more than once
+func (l *dirLock) release() {
+	l.once.Do(func() {
+		_ = unlock(l.file)
+		_ = l.file.Close()
+	})
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLockDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("data directories are not locked on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "repricer-lock-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{Path: dir, LockPollInterval: time.Millisecond}
+	standbyOpts := opts
+	standbyOpts.Standby = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lock, err := lockDirectory(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lockDirectory(ctx, opts); err != ErrLocked {
+		t.Error("locking a locked directory should fail", err)
+	}
+
+	standby := make(chan error, 1)
+	go func() {
+		lock, err := lockDirectory(ctx, standbyOpts)
+		if err == nil {
+			lock.release()
+		}
+		standby <- err
+	}()
+
+	select {
+	case err := <-standby:
+		t.Fatal("standby should wait for the lock to be released", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	lock.release()
+	lock.release() // should be a no-op
+
+	select {
+	case err := <-standby:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("standby should take over once the lock is released")
+	}
+
+	lock, err = lockDirectory(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+
+	standbyCtx, cancelStandby := context.WithCancel(ctx)
+	cancelStandby()
+	if _, err := lockDirectory(standbyCtx, standbyOpts); err != context.Canceled {
+		t.Error("standby should stop waiting when the context is done", err)
+	}
+}
@@ -0,0 +1,12 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// flock is not available on windows, so data directories are not locked
+var errWouldBlock = fmt.Errorf("would block")
+
+func tryLock(*os.File) error { return nil }
+func unlock(*os.File) error  { return nil }
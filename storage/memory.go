@@ -31,3 +31,48 @@ func (s *memStore) LastPrice(productId string) (json.Number, time.Time, error) {
 		return json.Number(""), time.Time{}, nil
 	}
 }
+
+// nullStore is a priceReader with no data, used as the snapshot of an empty
+// data directory
+type nullStore struct{}
+
+func (nullStore) HasPrice(string) bool { return false }
+func (nullStore) LastPrice(string) (json.Number, time.Time, error) {
+	return NullPrice, time.Time{}, nil
+}
+
+// syncedStore tracks the last price of every product whose record has been
+// synced to disk. Products which have not been updated since startup fall
+// back to the snapshot, since all of its data is already durable.
+type syncedStore struct {
+	sync.RWMutex
+	m        map[string]entry
+	snapshot priceReader
+}
+
+func newSyncedStore(snapshot priceReader) *syncedStore {
+	return &syncedStore{m: make(map[string]entry), snapshot: snapshot}
+}
+
+// SetPriceIfNewer records a synced price. Batches may be synced out of order,
+// so older entries are ignored.
+func (s *syncedStore) SetPriceIfNewer(productId string, price json.Number, t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if ent, exists := s.m[productId]; !exists || ent.Time.Before(t) {
+		s.m[productId] = entry{price, t}
+	}
+}
+
+func (s *syncedStore) LastPrice(productId string) (json.Number, time.Time, error) {
+	s.RLock()
+	ent, exists := s.m[productId]
+	s.RUnlock()
+
+	if exists {
+		return ent.Price, ent.Time, nil
+	}
+
+	return s.snapshot.LastPrice(productId)
+}
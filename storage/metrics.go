@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/nothingmuch/repricer/metrics"
+)
+
+// modelMetrics instruments the storage model. The zero value discards all
+// observations.
+type modelMetrics struct {
+	snapshotReadSeconds *metrics.Histogram
+	filesWritten        *metrics.Counter
+	recordsPerFile      *metrics.Histogram
+	resultsSyncSeconds  *metrics.Histogram
+	walSyncSeconds      *metrics.Histogram
+}
+
+func newModelMetrics(maxRecordsPerFile int) modelMetrics {
+	return modelMetrics{
+		snapshotReadSeconds: metrics.NewHistogram(metrics.DefaultBuckets),
+		filesWritten:        metrics.NewCounter(),
+		recordsPerFile:      metrics.NewHistogram(metrics.LinearBuckets(1, 1, maxRecordsPerFile)),
+		resultsSyncSeconds:  metrics.NewHistogram(metrics.DefaultBuckets),
+		walSyncSeconds:      metrics.NewHistogram(metrics.DefaultBuckets),
+	}
+}
+
+// RegisterMetrics adds the model's metrics to a registry
+func (m extendModel) RegisterMetrics(r *metrics.Registry) {
+	l := m.priceModel.(linearizedState)
+
+	queueLength := func(length func() int) metrics.GaugeFunc {
+		return func() float64 { return float64(length()) }
+	}
+	const queueHelp = "Number of items waiting in the storage model's internal queues."
+	r.Register("repricer_storage_queue_length", queueHelp, metrics.Labels{"queue": "new_price_records"}, queueLength(func() int { return len(l.newPriceRecords) }))
+	r.Register("repricer_storage_queue_length", queueHelp, metrics.Labels{"queue": "write_queue"}, queueLength(func() int { return len(l.writeQueue) }))
+	// requests are sent on an unbuffered channel, so the senders waiting on it
+	// are counted instead
+	r.Register("repricer_storage_queue_length", queueHelp, metrics.Labels{"queue": "last_price_requests"}, queueLength(func() int { return int(atomic.LoadInt64(&l.activity.pendingReads)) }))
+
+	r.Register("repricer_storage_snapshot_read_seconds", "Latency of reading last prices from the data directory.", nil, m.metrics.snapshotReadSeconds)
+	r.Register("repricer_storage_files_written_total", "Number of results files written, including a resumed one.", nil, m.metrics.filesWritten)
+	r.Register("repricer_storage_records_per_file", "Number of records in each finalized results file.", nil, m.metrics.recordsPerFile)
+	const fsyncHelp = "Latency of syncing files to disk."
+	r.Register("repricer_storage_fsync_seconds", fsyncHelp, metrics.Labels{"file": "results"}, m.metrics.resultsSyncSeconds)
+	r.Register("repricer_storage_fsync_seconds", fsyncHelp, metrics.Labels{"file": "wal"}, m.metrics.walSyncSeconds)
+}
+
+// timedReader measures the latency of a priceReader's reads
+type timedReader struct {
+	priceReader
+	latency *metrics.Histogram
+}
+
+func (r timedReader) LastPrice(productId string) (json.Number, time.Time, error) {
+	defer r.latency.ObserveSince(time.Now())
+	return r.priceReader.LastPrice(productId)
+}
@@ -1,22 +1,143 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/nothingmuch/repricer/logging"
+	"github.com/nothingmuch/repricer/metrics"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
 const (
 	NullPrice = json.Number("")
 )
 
-func New(path string) extendedPriceModel { // TODO return error, plumb errors & context
-	err := os.MkdirAll(filepath.Join(path, ResultsSubdirectory), 0777)
+// defaults of Options
+const (
+	DefaultMaxRecordsPerFile = 10
+	DefaultFlushInterval     = time.Second
+	DefaultWriteQueueLength  = 50
+	DefaultLockPollInterval  = time.Second
+	DefaultStallTimeout      = 30 * time.Second
+)
+
+// Options configures a storage model. Zero values are replaced by defaults.
+type Options struct {
+	// Path is the data directory, by default the working directory
+	Path string
+
+	// Standby makes New wait for the data directory lock if it's held by
+	// another process, instead of returning ErrLocked
+	Standby bool
+
+	// Logger, if not nil, is used to log errors that occur while
+	// persisting records. Errors attributable to a request are logged to
+	// the logger of the request's context instead, if it has one.
+	Logger *logging.Logger
+
+	// OnError, if not nil, is called with every error that occurs while
+	// persisting records, after it's logged, so that callers can react to
+	// it. It must be safe for concurrent use. After the first such error
+	// the model stops accepting updates.
+	OnError func(error)
+
+	// MaxRecordsPerFile bounds the number of records in a results file
+	MaxRecordsPerFile int
+
+	// FlushInterval is how long a results file accepts new records before
+	// it's synced and linked into the product directories
+	FlushInterval time.Duration
+
+	// WriteQueueLength is the number of accepted records which may be
+	// waiting to be written, beyond which updates are rejected
+	WriteQueueLength int
+
+	// LockPollInterval is how often a standby retries acquiring the data
+	// directory lock
+	LockPollInterval time.Duration
+
+	// StallTimeout is how long records may be queued without any of them
+	// being written before the writer is considered stalled
+	StallTimeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.Path == "" {
+		o.Path = "."
+	}
+	if o.MaxRecordsPerFile <= 0 {
+		o.MaxRecordsPerFile = DefaultMaxRecordsPerFile
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = DefaultFlushInterval
+	}
+	if o.WriteQueueLength <= 0 {
+		o.WriteQueueLength = DefaultWriteQueueLength
+	}
+	if o.LockPollInterval <= 0 {
+		o.LockPollInterval = DefaultLockPollInterval
+	}
+	if o.StallTimeout <= 0 {
+		o.StallTimeout = DefaultStallTimeout
+	}
+	return o
+}
+
+// New opens a storage model in a data directory. After an error persisting
+// records the model stops accepting updates.
+//
+// The data directory is locked exclusively while the model is open. If it's
+// already locked by another process ErrLocked is returned, unless
+// opts.Standby is true, in which case New waits for the lock to be released,
+// or for ctx to be done.
+//
+// The model is closed when ctx is done, or by calling Close, which waits until
+// all accepted updates have been persisted.
+func New(ctx context.Context, opts Options) (extendedPriceModel, error) {
+	opts = opts.withDefaults()
+
+	err := os.MkdirAll(filepath.Join(opts.Path, ResultsSubdirectory), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDirectory(ctx, opts)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return newFromFS(osFS(path))
+
+	m, err := newFromFS(ctx, osFS(opts.Path), opts)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	model := lockedModel{m, lock}
+
+	// the lock is held until the model is closed, either by Close or by
+	// ctx being done
+	go func() {
+		<-ctx.Done()
+		_ = model.Close()
+	}()
+
+	return model, nil
+}
+
+// lockedModel releases the data directory lock when closed
+type lockedModel struct {
+	extendedPriceModel
+	lock *dirLock
+}
+
+func (m lockedModel) Close() error {
+	err := m.extendedPriceModel.Close()
+	m.lock.release()
+	return err
 }
 
 type entry struct {
@@ -28,10 +149,20 @@ type record struct {
 	ProductId     string      `json:"productId"`
 	PreviousPrice json.Number `json:"previousPrice,omitempty"`
 	entry
+	provenance.Provenance
+
+	durable    chan<- error // if not nil, receives the outcome of syncing the record
+	logged     chan<- error // if not nil, receives the outcome of writing the record to the WAL
+	walSegment *walSegment
+	log        *logging.Logger // of the request which submitted the record
 }
 
 type priceUpdater interface {
-	UpdatePrice(productId string, price json.Number) error
+	UpdatePrice(ctx context.Context, productId string, price json.Number) error
+}
+
+type durablePriceUpdater interface {
+	UpdatePriceDurable(ctx context.Context, productId string, price json.Number) (previousPrice json.Number, timestamp time.Time, err error)
 }
 
 type priceReader interface {
@@ -39,17 +170,25 @@ type priceReader interface {
 	LastPrice(string) (json.Number, time.Time, error) // TODO(bikeshedding): (Entry, error) ?  (*Entry, error) to eliminate HasPrice?
 }
 
+type durablePriceReader interface {
+	// LastDurablePrice is like LastPrice but only reflects records that have
+	// been synced to disk
+	LastDurablePrice(context.Context, string) (json.Number, time.Time, error)
+}
+
 type priceLogRetriever interface {
 	PriceLog(
+		ctx context.Context,
 		productId string,
 		startTime, endTime time.Time,
 		offset int64, limit int,
 	) (
 		[]struct {
 			// TODO make Entry/Record types public?
-			ProductId string
-			Price     json.Number
-			Timestamp time.Time
+			ProductId  string
+			Price      json.Number
+			Timestamp  time.Time
+			Provenance provenance.Provenance
 		},
 		error,
 	)
@@ -64,7 +203,10 @@ type priceSetterAtomic interface {
 }
 
 type recordWriter interface {
-	writeRecord(record *record /*TODO chan struct{} closed on sync */) error
+	// writeRecord writes a record, and if synced is not nil, calls it once
+	// the record has been synced (or failed to)
+	writeRecord(record *record, synced func(error)) error
+	close() // flush any buffered records and wait until they're synced
 }
 
 type priceState interface {
@@ -74,12 +216,22 @@ type priceState interface {
 }
 
 type priceModel interface {
-	priceReader
+	// LastPrice is like priceReader's, but is made on behalf of a request
+	LastPrice(context.Context, string) (json.Number, time.Time, error)
+	durablePriceReader
 	priceUpdater
+	durablePriceUpdater
+	io.Closer
 }
 
 // price resource model, consumed by REST api
 type extendedPriceModel interface {
 	priceModel
 	priceLogRetriever
+	healthReporter
+}
+
+type healthReporter interface {
+	Health() Health
+	RegisterMetrics(*metrics.Registry)
 }
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// recoverResults repairs the damage a crash can leave behind in the last
+// results file, which is the only one that may have been open for writing:
+//   - a partially written record at the end of the file is truncated
+//   - a file with no complete records is removed
+//   - an unterminated file in the legacy JSON array format is rewritten as
+//     newline delimited JSON
+func recoverResults(fs fs) error {
+	for {
+		files, err := fs.Sub(ResultsSubdirectory).Files()
+		if err != nil || len(files) == 0 {
+			return err
+		}
+
+		name := filepath.Join(ResultsSubdirectory, files[len(files)-1])
+
+		f, err := fs.Open(name)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		if isLegacyFormat(data) {
+			if json.Valid(data) {
+				// a complete legacy file, nothing to recover
+				return nil
+			}
+
+			records := decodeLegacyPrefix(data)
+			if len(records) == 0 {
+				if err := fs.Remove(name); err != nil {
+					return err
+				}
+				continue
+			}
+
+			return rewriteRecords(fs, name, records)
+		}
+
+		complete := bytes.LastIndexByte(data, '\n') + 1
+		switch {
+		case complete == 0:
+			// no complete records were written, so this file
+			// can't have been linked into the product directories
+			if err := fs.Remove(name); err != nil {
+				return err
+			}
+		case complete < len(data):
+			return fs.Truncate(name, int64(complete))
+		default:
+			return nil
+		}
+	}
+}
+
+// resumableFile returns the last results file and its records if it can be
+// reopened for writing after a restart, which requires that it hasn't been
+// linked into any product directory, has room for more records, and is still
+// within its flush interval. Otherwise the returned records are nil.
+func resumableFile(fs fs, opts Options) (f filename, records []record, err error) {
+	files, err := fs.Sub(ResultsSubdirectory).Files()
+	if err != nil || len(files) == 0 {
+		return
+	}
+
+	// the name's nRecords and nProductIds fields may be stale
+	if err := f.parse(files[len(files)-1]); err != nil || time.Since(f.start) >= opts.FlushInterval {
+		return f, nil, nil
+	}
+
+	name := filepath.Join(ResultsSubdirectory, files[len(files)-1])
+	if links, err := fs.Links(name); err != nil || links != 1 {
+		return f, nil, err
+	}
+
+	r, err := fs.Open(name)
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil || isLegacyFormat(data) {
+		return
+	}
+
+	records, err = decodeRecords(data)
+	if err != nil || len(records) == 0 || len(records) >= opts.MaxRecordsPerFile {
+		return f, nil, err
+	}
+
+	return f, records, nil
+}
+
+// decodeLegacyPrefix returns all complete records from the beginning of a
+// (possibly unterminated) legacy JSON array
+func decodeLegacyPrefix(data []byte) (r []record) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if _, err := d.Token(); err != nil {
+		return
+	}
+
+	for d.More() {
+		var rec record
+		if err := d.Decode(&rec); err != nil {
+			return
+		}
+		r = append(r, rec)
+	}
+
+	return
+}
+
+// rewriteRecords atomically replaces a file with the newline delimited JSON
+// encoding of records, and then renames it so that its nRecords and
+// nProductIds fields match the records. Only files that have not yet been
+// linked into the product directories can be rewritten this way.
+func rewriteRecords(fs fs, name string, records []record) error {
+	tmp := filepath.Join(TemporarySubdirectory, filepath.Base(name))
+	_ = fs.Remove(tmp) // left over from a previous attempt
+
+	f, err := fs.New(tmp)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		by, err := json.Marshal(rec)
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		if _, err = f.Write(append(by, '\n')); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(tmp, name); err != nil {
+		return err
+	}
+
+	// if this rename is interrupted, the stale name is corrected by the
+	// consistency check on startup, since the file isn't linked
+	var corrected filename
+	if err := corrected.parse(filepath.Base(name)); err != nil {
+		return err
+	}
+	productIds := make(map[string]struct{})
+	for _, rec := range records {
+		productIds[rec.ProductId] = struct{}{}
+	}
+	corrected.nRecords, corrected.nProductIds = int64(len(records)), int64(len(productIds))
+
+	if correctedName := filepath.Join(ResultsSubdirectory, corrected.String()); correctedName != name {
+		if err := fs.Rename(name, correctedName); err != nil {
+			return err
+		}
+	}
+
+	return fs.SyncDirectory(ResultsSubdirectory)
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeResultsFile(t *testing.T, fs fs, f filename, data string) string {
+	name := filepath.Join(ResultsSubdirectory, f.String())
+	w, err := fs.New(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(data))
+	_ = w.Close()
+	return name
+}
+
+func readAll(t *testing.T, fs fs, name string) string {
+	r, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+const (
+	testRecord0 = `{"productId":"foo","newPrice":3.50,"timestamp":"2020-01-01T00:00:00Z"}`
+	testRecord1 = `{"productId":"bar","newPrice":2.20,"timestamp":"2020-01-01T00:00:01Z"}`
+)
+
+func TestRecoverTruncatesPartialRecord(t *testing.T) {
+	fs := newMemFS()
+	f := filename{fileSeq: 1, entrySeq: 1, nRecords: 1, nProductIds: 1, start: time.Now()}
+	name := writeResultsFile(t, fs, f, testRecord0+"\n"+testRecord1[:20])
+
+	if err := recoverResults(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := readAll(t, fs, name); data != testRecord0+"\n" {
+		t.Error("partial record should have been truncated", data)
+	}
+
+	records, err := priceLoader{fs}.loadFile(fs, name)
+	if err != nil || len(records) != 1 {
+		t.Error("recovered file should have one record", records, err)
+	}
+}
+
+func TestRecoverRemovesEmptyFile(t *testing.T) {
+	fs := newMemFS()
+	start := time.Now()
+	f0 := filename{fileSeq: 1, entrySeq: 1, nRecords: 1, nProductIds: 1, start: start}
+	f1 := filename{fileSeq: 2, entrySeq: 2, start: start.Add(time.Second)}
+	n0 := writeResultsFile(t, fs, f0, testRecord0+"\n")
+	n1 := writeResultsFile(t, fs, f1, testRecord1[:10])
+
+	if err := recoverResults(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Open(n1); err == nil {
+		t.Error("file with no complete records should have been removed")
+	}
+
+	if data := readAll(t, fs, n0); data != testRecord0+"\n" {
+		t.Error("previous file should be left untouched", data)
+	}
+}
+
+func TestRecoverLegacyFormat(t *testing.T) {
+	fs := newMemFS()
+	f := filename{fileSeq: 1, entrySeq: 1, nRecords: 2, nProductIds: 2, start: time.Now()}
+
+	complete := "[\n\t" + testRecord0 + ",\n\t" + testRecord1 + "\n]\n"
+	name := writeResultsFile(t, fs, f, complete)
+
+	if err := recoverResults(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if data := readAll(t, fs, name); data != complete {
+		t.Error("complete legacy file should be left untouched")
+	}
+
+	records, err := priceLoader{fs}.loadFile(fs, name)
+	if err != nil || len(records) != 2 {
+		t.Error("legacy file should still be readable", records, err)
+	}
+
+	// the name of the unterminated file counts the partial record
+	f.fileSeq++
+	f.entrySeq += 2
+	stale := writeResultsFile(t, fs, f, "[\n\t"+testRecord0+",\n\t"+testRecord1[:30])
+
+	if err := recoverResults(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	f.nRecords, f.nProductIds = 1, 1
+	name = filepath.Join(ResultsSubdirectory, f.String())
+	if data := readAll(t, fs, name); data != testRecord0+"\n" {
+		t.Error("unterminated legacy file should have been rewritten as NDJSON", data)
+	}
+	if _, err := fs.Open(stale); err == nil {
+		t.Error("rewritten file should have been renamed to match its records")
+	}
+}
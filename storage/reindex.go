@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+var (
+	// reindexSubdirectory is where the product directories are rebuilt
+	reindexSubdirectory = filepath.Join(TemporarySubdirectory, "reindex")
+
+	// replacedSubdirectory is where the old product directories are moved
+	// before they're removed
+	replacedSubdirectory = filepath.Join(TemporarySubdirectory, "replaced")
+)
+
+// Reindex regenerates the product directories of a data directory from the
+// results directory, computing the entrySeq and nRecords fields of every link
+// the same way batch.flush does. Results files whose names don't match their
+// contents are renamed first. The directory is locked while reindexing, so it
+// can't be used while the service is running.
+//
+// The new product directories are built in a temporary directory while the
+// results directory is checked, and only replace the existing ones if no
+// violations were found that would make the names of the links unreliable,
+// i.e. those of the fileSeq, start, nRecords or nProductIds fields of results
+// files. Other violations, like gaps between the entrySeq fields of
+// consecutive files or inconsistent previousPrice fields, are only reported.
+//
+// The existing product directories are replaced with two renames, so there's
+// a moment in which there are none, while the old links still count towards
+// the link counts of the results files. If it's interrupted it must therefore
+// be run again before the service is started.
+//
+// This is needed after restoring only the results directory from a backup, or
+// if the product directories are suspected to be corrupt.
+//
+// The returned report lists the renamed results files and the links that were
+// created as repairs, and any violations found in the results directory, which
+// are not repaired.
+func Reindex(ctx context.Context, path string) (Report, error) {
+	lock, err := lockDirectory(ctx, Options{Path: path})
+	if err != nil {
+		return Report{}, err
+	}
+	defer lock.release()
+
+	return reindex(osFS(path))
+}
+
+func reindex(fs fs) (Report, error) {
+	// the last file may have a partially written record, which must be
+	// removed before it's linked
+	if err := recoverResults(fs); err != nil {
+		return Report{}, err
+	}
+
+	// left behind by an interrupted reindex
+	for _, dir := range []string{reindexSubdirectory, replacedSubdirectory} {
+		if err := removeLinkDirectories(fs, dir); err != nil {
+			return Report{}, err
+		}
+	}
+
+	// a deep check tracks the entrySeq of every product from the beginning
+	// of the results directory, and creates every missing link
+	c := checker{fs: fs, repair: fs, deep: true, reindexing: true, products: reindexSubdirectory}
+	if err := c.run(); err != nil {
+		return c.Report, err
+	}
+
+	if c.indexViolations > 0 {
+		if err := removeLinkDirectories(fs, reindexSubdirectory); err != nil {
+			return c.Report, err
+		}
+		return c.Report, errors.New(errors.Corrupt, "the results directory has violations affecting the names of links, so the product directories were not replaced")
+	}
+
+	// the new directories replace the old ones by renaming, which is made
+	// durable before the old links are removed. either directory may not
+	// exist if there are no results files.
+	if err := fs.Rename(ProductSubdirectory, replacedSubdirectory); err != nil && !os.IsNotExist(err) {
+		return c.Report, err
+	}
+	if err := fs.Rename(reindexSubdirectory, ProductSubdirectory); err != nil && !os.IsNotExist(err) {
+		return c.Report, err
+	}
+	if err := fs.SyncDirectory("."); err != nil {
+		return c.Report, err
+	}
+
+	// the links were reported where they were created
+	for i, repair := range c.Repairs {
+		c.Repairs[i] = strings.Replace(repair, reindexSubdirectory, ProductSubdirectory, 1)
+	}
+
+	return c.Report, removeLinkDirectories(fs, replacedSubdirectory)
+}
+
+// removeLinkDirectories removes all files from a directory of product
+// directories, such as ProductSubdirectory, and the directories themselves
+func removeLinkDirectories(fs fs, dir string) error {
+	hashes, err := fs.Sub(dir).Files()
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		productDirectory := filepath.Join(dir, hash)
+
+		names, err := fs.Sub(productDirectory).Files()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := fs.Remove(filepath.Join(productDirectory, name)); err != nil {
+				return err
+			}
+		}
+
+		// directories are implicit in some filesystems
+		if err := fs.Remove(productDirectory); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := fs.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nothingmuch/repricer/errors"
+)
+
+func TestReindex(t *testing.T) {
+	fs := newMemFS()
+	w := batchWriter{fs: fs, maxRecords: 2, flushInterval: time.Minute}
+
+	t0 := time.Now().UTC().Truncate(0)
+	prices := map[string]json.Number{}
+	for i, productId := range []string{"foo", "bar", "foo", "foo", "bar"} {
+		price := json.Number(fmt.Sprintf("%d.00", i+1))
+		err := w.writeRecord(&record{ProductId: productId, PreviousPrice: prices[productId], entry: entry{Price: price, Time: t0.Add(time.Duration(i))}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prices[productId] = price
+	}
+	w.close()
+
+	links := func() []string {
+		files, err := fs.allFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var links []string
+		for _, name := range files {
+			if filepath.Dir(filepath.Dir(name)) == ProductSubdirectory {
+				links = append(links, name)
+			}
+		}
+		return links
+	}
+	expected := links()
+
+	// corrupt the index with a missing link and a link with the wrong
+	// entrySeq in a stray directory
+	_ = fs.Remove(expected[0])
+	stray := filename{fileSeq: 1, entrySeq: 7, nRecords: 1, nProductIds: 1, start: t0}
+	_ = fs.Link(expected[1], filepath.Join(ProductSubdirectory, ProductIdHash("baz"), stray.String()))
+
+	if report, _ := Check(fs); len(report.Violations) == 0 {
+		t.Fatal("corrupt index should be detected")
+	}
+
+	// left behind by an interrupted reindex
+	_ = fs.Link(expected[1], filepath.Join(reindexSubdirectory, ProductIdHash("baz"), stray.String()))
+
+	report, err := reindex(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repairs) != len(expected) || len(report.Violations) != 0 {
+		t.Error("every link should have been recreated", report)
+	}
+	for _, repair := range report.Repairs {
+		if !strings.Contains(repair, "linked to "+ProductSubdirectory) {
+			t.Error("links should be reported in the product directories", repair)
+		}
+	}
+	if files, _ := fs.Sub(TemporarySubdirectory).Files(); len(files) != 0 {
+		t.Error("no temporary directories should be left behind", files)
+	}
+
+	actual := links()
+	if len(actual) != len(expected) {
+		t.Fatal("index should have the same links as before", actual, expected)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Error("link should have the same name as the one made by batch.flush", actual[i], expected[i])
+		}
+	}
+
+	if report, err := Check(fs); err != nil || len(report.Violations) != 0 {
+		t.Error("reindexed data directory should be consistent", report, err)
+	}
+}
+
+func TestReindexViolations(t *testing.T) {
+	written := func() *memFS {
+		fs := newMemFS()
+		w := batchWriter{fs: fs, maxRecords: 1, flushInterval: time.Minute}
+
+		// the previousPrice fields are missing
+		t0 := time.Now().UTC().Truncate(0)
+		for i, price := range []json.Number{"1.00", "2.00", "3.00"} {
+			err := w.writeRecord(&record{ProductId: "foo", entry: entry{Price: price, Time: t0.Add(time.Duration(i))}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.close()
+		return fs
+	}
+	rename := func(fs *memFS, i int, change func(*filename)) {
+		names, _ := fs.Sub(ResultsSubdirectory).Files()
+		var f filename
+		if err := f.FromString(names[i]); err != nil {
+			t.Fatal(err)
+		}
+		change(&f)
+		_ = fs.Rename(filepath.Join(ResultsSubdirectory, names[i]), filepath.Join(ResultsSubdirectory, f.String()))
+	}
+
+	// a stale name, and a gap in the entrySeq of the results files, as
+	// left by restarts of older versions
+	fs := written()
+	rename(fs, 0, func(f *filename) { f.nRecords = 2 })
+	rename(fs, 2, func(f *filename) { f.entrySeq += 5 })
+
+	report, err := reindex(fs)
+	if err != nil {
+		t.Fatal("violations that don't affect the links should not abort the reindex", err)
+	}
+	if len(report.Violations) == 0 {
+		t.Error("violations should be reported", report)
+	}
+	for _, violation := range report.Violations {
+		if strings.Contains(violation.Error(), "nRecords") {
+			t.Error("renamed files should be reported as repairs", violation)
+		}
+	}
+	if len(report.Repairs) != 4 {
+		t.Error("stale name should be repaired, and every link recreated", report.Repairs)
+	}
+	if report, _ := Check(fs); strings.Contains(fmt.Sprint(report.Violations), "link") {
+		t.Error("reindexed data directory should have no link violations", report.Violations)
+	}
+
+	// a start time which doesn't match the contents
+	fs = written()
+	rename(fs, 1, func(f *filename) { f.start = f.start.Add(time.Second) })
+	before, _ := fs.allFiles()
+
+	if _, err := reindex(fs); errors.CodeOf(err) != errors.Corrupt {
+		t.Fatal("violations affecting the names of links should abort the reindex", err)
+	}
+
+	after, _ := fs.allFiles()
+	if fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Error("product directories should not be replaced after finding violations", after, before)
+	}
+}
@@ -1,24 +1,74 @@
 package storage
 
-func newFromFS(fs fs) extendedPriceModel { // TODO return error
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+func newFromFS(ctx context.Context, fs fs, opts Options) (extendedPriceModel, error) {
+	opts = opts.withDefaults()
+	log := opts.Logger
+
+	failed := newFailure(func(err error) {
+		log.Error("storage error", "error", err)
+		if opts.OnError != nil {
+			opts.OnError(err)
+		}
+	})
 	memstore := &memStore{}
-	batchWriter := &batchWriter{fs: fs}
-	var previousPrices priceReader = memstore // TODO null store?
+	metrics := newModelMetrics(opts.MaxRecordsPerFile)
+	batchWriter := &batchWriter{
+		fs:            fs,
+		fail:          failed.fail,
+		metrics:       metrics,
+		maxRecords:    opts.MaxRecordsPerFile,
+		flushInterval: opts.FlushInterval,
+	}
+	var previousPrices priceReader = nullStore{}
+
+	// the last file may have been left partially written by a crash
+	err := recoverResults(fs)
+	if err != nil {
+		return nil, fmt.Errorf("recovering results: %w", err)
+	}
+
+	// if the process restarted while the last file was still being
+	// written, writing continues as if the restart never happened
+	resumed, resumedRecords, err := resumableFile(fs, opts)
+	if err != nil {
+		return nil, fmt.Errorf("finding resumable file: %w", err)
+	}
+	var resuming string
+	if resumedRecords != nil {
+		resuming = filepath.Join(ResultsSubdirectory, resumed.String())
+	}
 
-	// TODO check link count consistency
-	// TODO check nRrecords fields and rename appropriately
-	// TODO entrySeq's for product directories? do lazily...
+	// other files which were not finalized before a crash need to be linked
+	// into the product directories before any snapshot reads are made
+	report, err := checkConsistency(fs, true, resuming)
+	if err != nil {
+		return nil, fmt.Errorf("checking consistency: %w", err)
+	}
+	for _, violation := range report.Violations {
+		log.Warn("inconsistency found on startup", "violation", violation)
+	}
+	for _, repair := range report.Repairs {
+		log.Info("repaired on startup", "repair", repair)
+	}
 
 	// restore sequence numbers from results directory
 	files, err := fs.Sub(ResultsSubdirectory).Files()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("listing results: %w", err)
 	}
+	var lastTime time.Time // of the last record in the results directory
 	if len(files) > 0 {
 		var f filename
 		err := f.FromString(files[len(files)-1])
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 
 		previousPrices = priceLoader{
@@ -29,14 +79,79 @@ func newFromFS(fs fs) extendedPriceModel { // TODO return error
 		}
 
 		batchWriter.fileSeq = f.fileSeq
-		batchWriter.entrySeq = f.entrySeq
+		batchWriter.entrySeq = f.entrySeq + f.nRecords - 1
+
+		records, err := priceLoader{fs}.loadFile(fs, filepath.Join(ResultsSubdirectory, files[len(files)-1]))
+		if err != nil {
+			return nil, fmt.Errorf("loading last results file: %w", err)
+		}
+		if len(records) > 0 {
+			lastTime = records[len(records)-1].entry.Time
+		}
+	}
+
+	if resumedRecords != nil {
+		if err := batchWriter.resume(resumed, resumedRecords); err != nil {
+			return nil, fmt.Errorf("resuming %s: %w", resuming, err)
+		}
+
+		// the resumed file isn't visible in the product directories
+		// until it's finalized, so its prices are loaded into memory
+		for _, rec := range resumedRecords {
+			_ = memstore.SetPrice(rec.ProductId, rec.entry.Price, rec.entry.Time)
+		}
+	}
+
+	// records which were accepted but didn't make it to the results
+	// directory before a crash are replayed from the write ahead log
+	writeAheadLog, segments, replayed, err := openWAL(fs, failed, lastTime, metrics.walSyncSeconds, opts.WriteQueueLength)
+	if err != nil {
+		return nil, fmt.Errorf("opening write ahead log: %w", err)
+	}
+
+	previousPrices = timedReader{previousPrices, metrics.snapshotReadSeconds}
+	model := linearizeUpdates(memstore, previousPrices, batchWriter, failed, writeAheadLog, log, opts.WriteQueueLength)
+
+	// the resumed file has been synced
+	for _, rec := range resumedRecords {
+		model.synced.SetPriceIfNewer(rec.ProductId, rec.entry.Price, rec.entry.Time)
+	}
+
+	if len(replayed) > 0 {
+		log.Info("replaying records from write ahead log", "records", len(replayed))
+	}
+	for _, rec := range replayed {
+		if err := model.replay(rec); err != nil {
+			_ = model.Close()
+			return nil, fmt.Errorf("replaying write ahead log: %w", err)
+		}
 	}
 
-	// TODO plumb errors, context
+	// replayed records have been logged again in new segments
+	writeAheadLog.remove(segments)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = model.Close()
+		case <-model.done:
+		}
+	}()
+
 	return extendModel{
-		priceModel:        linearizeUpdates(memstore, previousPrices, batchWriter),
+		priceModel:        model,
 		priceLogRetriever: priceLoader{fs},
-	}
+		fs:                fs,
+		metrics:           metrics,
+		stallTimeout:      opts.StallTimeout,
+		writable:          &writableCache{},
+		startup: StartupStatus{
+			Violations: len(report.Violations),
+			Repairs:    len(report.Repairs),
+			Replayed:   len(replayed),
+			Resumed:    resumedRecords != nil,
+		},
+	}, nil
 }
 
 // FIXME refactor, used to decorate priceModel with additional log fetching API,
@@ -44,6 +159,26 @@ func newFromFS(fs fs) extendedPriceModel { // TODO return error
 type extendModel struct {
 	priceModel
 	priceLogRetriever
+
+	fs           writeFS
+	metrics      modelMetrics
+	stallTimeout time.Duration
+	writable     *writableCache
+	startup      StartupStatus
 }
 
 var _ extendedPriceModel = extendModel{}
+
+// Health reports the state of the model and its data directory
+func (m extendModel) Health() Health {
+	h := m.priceModel.(linearizedState).health(m.stallTimeout)
+	h.Startup = m.startup
+
+	if err := m.writable.check(m.fs); err != nil {
+		h.WritableError = err.Error()
+	} else {
+		h.Writable = true
+	}
+
+	return h
+}
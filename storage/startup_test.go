@@ -1,15 +1,27 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/nothingmuch/repricer/errors"
+	"github.com/nothingmuch/repricer/provenance"
 )
 
-func init() {
-	FlushInterval = 10 * time.Millisecond
+// tests flush files quickly to be more responsive
+const testFlushInterval = 10 * time.Millisecond
+
+var testOptions = Options{FlushInterval: testFlushInterval}
+
+func mustNewFromFS(tb testing.TB, ctx context.Context, fs fs, opts Options) extendedPriceModel {
+	tb.Helper()
+	model, err := newFromFS(ctx, fs, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return model
 }
 
 func TestSnapshotConsistency(t *testing.T) {
@@ -36,7 +48,7 @@ func TestSnapshotConsistency(t *testing.T) {
 	checkModelConsistency()
 	_ = m.UpdatePrice("qux", "2.22")
 	checkModelConsistency()
-	time.Sleep(FlushInterval)
+	time.Sleep(testFlushInterval)
 	m.checkpoint()
 	checkModelConsistency()
 	_ = m.UpdatePrice("foo", "3.75")
@@ -47,7 +59,7 @@ func TestSnapshotConsistency(t *testing.T) {
 	checkModelConsistency()
 	_ = m.UpdatePrice("wat", "0.01")
 	checkModelConsistency()
-	time.Sleep(FlushInterval)
+	time.Sleep(testFlushInterval)
 	checkModelConsistency()
 	_ = m.UpdatePrice("baz", "1.79")
 	checkModelConsistency()
@@ -64,24 +76,24 @@ type modelStack struct {
 }
 
 func (s modelStack) checkpoint() {
-	time.Sleep(2 * FlushInterval) // allow all buffers to flush // FIXME really hacky
-	s.models = append(s.models, newFromFS(s.fs.(*memFS).clone()))
+	time.Sleep(2 * testFlushInterval) // allow all buffers to flush // FIXME really hacky
+	s.models = append(s.models, mustNewFromFS(s, context.Background(), s.fs.(*memFS).clone(), testOptions))
 }
 
 func (s *modelStack) UpdatePrice(productId string, price json.Number) (err error) {
 	if len(s.models) == 0 {
-		s.models = []priceModel{newFromFS(s.fs)}
+		s.models = []priceModel{mustNewFromFS(s, context.Background(), s.fs, testOptions)}
 	}
 
 	for _, model := range s.models {
-		errors.Collect(&err, model.UpdatePrice(productId, price))
+		errors.Collect(&err, model.UpdatePrice(context.Background(), productId, price))
 	}
 	return
 }
 
 func (s modelStack) LastPrice(productId string) (p json.Number, t time.Time, err error) {
 	for i, model := range s.models {
-		mp, mt, merr := model.LastPrice(productId)
+		mp, mt, merr := model.LastPrice(context.Background(), productId)
 
 		if i == 0 {
 			p, t, err = mp, mt, merr
@@ -94,3 +106,183 @@ func (s modelStack) LastPrice(productId string) (p json.Number, t time.Time, err
 
 	return
 }
+
+func TestClose(t *testing.T) {
+	fs := newMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, fs, testOptions)
+
+	for _, productId := range []string{"foo", "bar", "foo", "baz"} {
+		if err := model.UpdatePrice(ctx, productId, "1.00"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := model.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// all records should have been written, synced and linked
+	report, err := Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 4 || len(report.Violations) != 0 || len(report.Pending) != 0 {
+		t.Error("all accepted updates should have been persisted", report)
+	}
+
+	if err := model.UpdatePrice(ctx, "foo", "2.00"); err == nil {
+		t.Error("updates should be rejected after closing")
+	}
+
+	if price, _, err := model.LastPrice(ctx, "foo"); err != nil || price != "1.00" {
+		t.Error("in memory reads should still be possible after closing", price, err)
+	}
+
+	if err := model.Close(); err != nil {
+		t.Error("closing again should be a no-op", err)
+	}
+
+	// cancelling the context should also close the model
+	model = mustNewFromFS(t, ctx, fs, testOptions)
+	_ = model.UpdatePrice(ctx, "qux", "3.00")
+	cancel()
+
+	select {
+	case <-model.(extendModel).priceModel.(linearizedState).done:
+	case <-time.After(time.Second):
+		t.Fatal("model should have been closed after cancelling context")
+	}
+
+	report, _ = Check(fs)
+	if report.Records != 5 || len(report.Violations) != 0 {
+		t.Error("update should have been persisted after cancelling context", report)
+	}
+}
+
+func TestUpdatePriceDurable(t *testing.T) {
+	fs := newMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, fs, testOptions)
+	defer model.Close()
+
+	if err := model.UpdatePrice(ctx, "foo", "1.00"); err != nil {
+		t.Fatal(err)
+	}
+
+	previousPrice, timestamp, err := model.UpdatePriceDurable(ctx, "foo", "2.00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if previousPrice != "1.00" || timestamp.IsZero() {
+		t.Error("finalized record should be returned", previousPrice, timestamp)
+	}
+
+	// durable updates must be visible to durable reads
+	if price, ts, err := model.LastDurablePrice(ctx, "foo"); err != nil || price != "2.00" || !ts.Equal(timestamp) {
+		t.Error("durable read should reflect durable update", price, ts, err)
+	}
+
+	// both records must have been synced by the time the update returns
+	report, err := Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 2 || len(report.Violations) != 0 {
+		t.Error("durable update should have been persisted", report)
+	}
+}
+
+func TestProvenanceRecorded(t *testing.T) {
+	fs := newMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, fs, testOptions)
+	defer model.Close()
+
+	authenticated := provenance.NewContext(ctx, provenance.Provenance{Principal: "pricing", RequestID: "abc123"})
+	if _, _, err := model.UpdatePriceDurable(authenticated, "foo", "1.00"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := model.UpdatePriceDurable(ctx, "foo", "2.00"); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []record
+	files, _ := fs.Sub(ResultsSubdirectory).Files()
+	for _, name := range files {
+		r, err := priceLoader{fs}.loadFile(fs.Sub(ResultsSubdirectory), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r...)
+	}
+
+	if len(records) != 2 || records[0].Principal != "pricing" || records[0].RequestID != "abc123" || records[1].Provenance != (provenance.Provenance{}) {
+		t.Error("provenance should be recorded with each record", records)
+	}
+
+	log, err := model.PriceLog(ctx, "foo", time.Time{}, time.Time{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].Provenance != records[0].Provenance {
+		t.Error("provenance should be returned in the price log", log)
+	}
+}
+
+func TestResumeLastFile(t *testing.T) {
+	// the restart must happen before the batch is flushed
+	opts := testOptions
+	opts.FlushInterval = time.Minute
+
+	fs := newMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, fs, opts)
+	defer model.Close()
+
+	_ = model.UpdatePrice(ctx, "foo", "1.00")
+	_ = model.UpdatePrice(ctx, "bar", "2.00")
+
+	// wait for both records to be written before simulating a crash
+	var crashed *memFS
+	for deadline := time.Now().Add(time.Second); crashed == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("records were not written")
+		}
+		files, _ := fs.Sub(ResultsSubdirectory).Files()
+		if len(files) == 1 {
+			var f filename
+			if err := f.FromString(files[0]); err == nil && f.nRecords == 2 {
+				crashed = fs.clone()
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	model = mustNewFromFS(t, ctx, crashed, opts)
+	_ = model.UpdatePrice(ctx, "foo", "3.00")
+	if err := model.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := model.(extendModel).metrics.filesWritten.Value(); n != 1 {
+		t.Error("the resumed file should be counted as written", n)
+	}
+
+	report, err := Check(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 1 || report.Records != 3 || len(report.Violations) != 0 || len(report.Pending) != 0 {
+		t.Error("writing should have continued in the last file", report)
+	}
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"time"
+)
+
+// Stats summarizes the contents of a data directory
+type Stats struct {
+	Files    int   `json:"files"`    // number of results files
+	Records  int64 `json:"records"`  // number of records in the results files
+	Products int   `json:"products"` // number of product directories
+
+	LastFileSeq  int64 `json:"lastFileSeq,omitempty"`
+	LastEntrySeq int64 `json:"lastEntrySeq,omitempty"`
+
+	// start times of the first and last results files
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+
+	// number of write ahead log segments, which are only left behind if
+	// the service stopped before syncing all of the records they contain
+	WALSegments int `json:"walSegments"`
+}
+
+// Stat summarizes a data directory from the names of its files, without
+// reading their contents. Like Check, it's safe to run while the directory is
+// being written to.
+func Stat(fs readFS) (s Stats, err error) {
+	files, err := fs.Sub(ResultsSubdirectory).Files()
+	if err != nil {
+		return s, err
+	}
+
+	for i, name := range files {
+		var f filename
+		if err := f.FromString(name); err != nil {
+			return s, err
+		}
+
+		s.Files++
+		s.Records += f.nRecords
+
+		if i == 0 {
+			s.First = f.start
+		}
+		s.Last = f.start
+		s.LastFileSeq = f.fileSeq
+		s.LastEntrySeq = f.entrySeq + f.nRecords - 1
+	}
+
+	products, err := fs.Sub(ProductSubdirectory).Files()
+	if err != nil {
+		return s, err
+	}
+	s.Products = len(products)
+
+	segments, err := fs.Sub(WALSubdirectory).Files()
+	if err != nil {
+		return s, err
+	}
+	s.WALSegments = len(segments)
+
+	return s, nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStat(t *testing.T) {
+	fs := newMemFS()
+	if s, err := Stat(fs); err != nil || s.Files != 0 || !s.First.IsZero() {
+		t.Error("empty data directory should have no files", s, err)
+	}
+
+	w := batchWriter{fs: fs, maxRecords: 2, flushInterval: time.Minute}
+	t0 := time.Now().UTC().Truncate(0)
+	for i, productId := range []string{"foo", "bar", "foo"} {
+		err := w.writeRecord(&record{ProductId: productId, entry: entry{Price: json.Number("1.00"), Time: t0.Add(time.Duration(i))}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+
+	s, err := Stat(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Files != 2 || s.Records != 3 || s.Products != 2 || s.LastFileSeq != 2 || s.LastEntrySeq != 3 {
+		t.Error("stats should summarize the results files", s)
+	}
+	if !s.First.Equal(t0) || !s.Last.Equal(t0.Add(2)) {
+		t.Error("stats should have the start times of the first and last files", s.First, s.Last)
+	}
+}
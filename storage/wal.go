@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nothingmuch/repricer/metrics"
+)
+
+const (
+	// WALSubdirectory holds the write ahead log of accepted records which
+	// may not have been written to the results directory yet
+	WALSubdirectory = "wal"
+
+	MaxRecordsPerWALSegment = 1000
+)
+
+// wal is an append only log of records, written as soon as they are
+// timestamped by the linearizer, so that records which were accepted but not
+// yet finalized or synced in the results directory survive a crash.
+//
+// Records are appended in batches and synced together (group commit). A
+// segment is removed once it's no longer being appended to, and all of its
+// records have been synced to the results directory.
+//
+// A nil *wal is valid and logs nothing.
+type wal struct {
+	fs          writeFS
+	failed      *failure
+	syncSeconds *metrics.Histogram
+
+	entries chan walEntry
+	done    chan struct{}
+
+	sync.Mutex
+	seq     int64       // sequence number of the current segment
+	current *walSegment // owned by the appending goroutine
+}
+
+type walSegment struct {
+	name     string
+	nRecords int  // number of records appended
+	pending  int  // number of appended records not yet synced to results
+	sealed   bool // the segment file is closed and will not be appended to
+}
+
+type walEntry struct {
+	segment *walSegment
+	record
+	logged chan<- error
+}
+
+// walSegmentName returns the path of the segment with the given sequence number
+func walSegmentName(seq int64) string {
+	return filepath.Join(WALSubdirectory, fmt.Sprintf("%016x", seq))
+}
+
+// openWAL reads the existing segments of the log, returning their names and
+// any records with a timestamp after `after`, which is the time of the last
+// record in the results directory. New segments are numbered after existing
+// ones. The latency of syncs is observed by syncSeconds, which may be nil.
+// Up to queueLength entries may be buffered before they're written.
+func openWAL(fs fs, failed *failure, after time.Time, syncSeconds *metrics.Histogram, queueLength int) (w *wal, segments []string, records []record, err error) {
+	w = &wal{
+		fs:          fs,
+		failed:      failed,
+		syncSeconds: syncSeconds,
+		entries:     make(chan walEntry, queueLength),
+		done:        make(chan struct{}),
+	}
+
+	names, err := fs.Sub(WALSubdirectory).Files()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, name := range names {
+		var seq int64
+		if _, err := fmt.Sscanf(name, "%016x", &seq); err != nil {
+			return nil, nil, nil, fmt.Errorf("unparseable WAL segment name %q: %w", name, err)
+		}
+		if seq > w.seq {
+			w.seq = seq
+		}
+
+		path := filepath.Join(WALSubdirectory, name)
+		segments = append(segments, path)
+
+		f, err := fs.Open(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// a partially written record at the end of the segment was
+		// never acknowledged, and is ignored
+		logged, err := decodeRecords(data)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading WAL segment %s: %w", path, err)
+		}
+
+		for _, rec := range logged {
+			if rec.entry.Time.After(after) {
+				records = append(records, rec)
+			}
+		}
+	}
+
+	go w.writeEntries()
+
+	return w, segments, records, nil
+}
+
+// append queues a record to be logged, and returns the segment it will be
+// written to. rec.logged is notified once the record has been synced.
+//
+// It must only be called from a single goroutine, which is also the one that
+// calls close.
+func (w *wal) append(rec *record) *walSegment {
+	if w == nil {
+		if rec.logged != nil {
+			rec.logged <- nil
+		}
+		return nil
+	}
+
+	w.Lock()
+	if w.current == nil || w.current.nRecords == MaxRecordsPerWALSegment {
+		w.seq++
+		w.current = &walSegment{name: walSegmentName(w.seq)}
+	}
+	segment := w.current
+	segment.nRecords++
+	segment.pending++
+	w.Unlock()
+
+	// previousPrice is not yet known, and will be filled in on replay
+	w.entries <- walEntry{
+		segment: segment,
+		record:  record{ProductId: rec.ProductId, entry: rec.entry, Provenance: rec.Provenance},
+		logged:  rec.logged,
+	}
+
+	return segment
+}
+
+// synced marks a record of a segment as synced to the results directory
+func (w *wal) synced(segment *walSegment) {
+	if w == nil || segment == nil {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	segment.pending--
+	w.removeIfDone(segment)
+}
+
+// close stops appending and waits for all queued records to be logged
+func (w *wal) close() {
+	if w == nil {
+		return
+	}
+
+	close(w.entries)
+	<-w.done
+}
+
+// remove deletes segments that were replayed, once their records have
+// been logged again
+func (w *wal) remove(segments []string) {
+	for _, name := range segments {
+		if err := w.fs.Remove(name); err != nil {
+			w.failed.report(fmt.Errorf("removing WAL segment: %w", err))
+		}
+	}
+}
+
+// must be called with the lock held
+func (w *wal) removeIfDone(segment *walSegment) {
+	if !segment.sealed || segment.pending > 0 {
+		return
+	}
+
+	// a leftover segment is harmless, since records that are already in
+	// the results directory are not replayed
+	if err := w.fs.Remove(segment.name); err != nil {
+		w.failed.report(fmt.Errorf("removing WAL segment: %w", err))
+	}
+}
+
+// writeEntries appends queued records to the log, syncing all the records
+// that are available at once before acknowledging them
+func (w *wal) writeEntries() {
+	defer close(w.done)
+
+	var (
+		segment *walSegment
+		file    appendFile
+		err     error // once an error occurs the log can't be trusted
+	)
+
+	closeSegment := func() {
+		if file != nil {
+			_ = file.Close()
+			file = nil
+		}
+		if segment != nil {
+			w.Lock()
+			segment.sealed = true
+			w.removeIfDone(segment)
+			w.Unlock()
+			segment = nil
+		}
+	}
+	defer closeSegment()
+
+	for e := range w.entries {
+		group := []walEntry{e}
+	drain:
+		for len(group) < cap(w.entries) {
+			select {
+			case e, ok := <-w.entries:
+				if !ok {
+					break drain
+				}
+				group = append(group, e)
+			default:
+				break drain
+			}
+		}
+
+		for _, e := range group {
+			if err != nil {
+				break
+			}
+
+			if e.segment != segment {
+				if file != nil {
+					err = file.Sync() // FIXME retry? see fsyncgate
+				}
+				closeSegment()
+				if err != nil {
+					break
+				}
+
+				segment = e.segment
+				err = retry(func() (err error) {
+					file, err = w.fs.New(segment.name)
+					return
+				})
+				if err != nil {
+					err = fmt.Errorf("creating WAL segment %s: %w", segment.name, err)
+					break
+				}
+
+				// records in the segment are acknowledged once it's
+				// synced, which is only durable if its name is too
+				if err = w.fs.SyncDirectory(WALSubdirectory); err != nil {
+					err = fmt.Errorf("syncing WAL directory: %w", err)
+					break
+				}
+			}
+
+			var by []byte
+			by, err = json.Marshal(e.record)
+			if err == nil {
+				_, err = file.Write(append(by, '\n'))
+			}
+			if err != nil {
+				err = fmt.Errorf("writing WAL segment %s: %w", segment.name, err)
+			}
+		}
+
+		if err == nil && file != nil {
+			start := time.Now()
+			err = file.Sync()
+			w.syncSeconds.ObserveSince(start)
+			if err != nil {
+				err = fmt.Errorf("syncing WAL segment %s: %w", segment.name, err)
+			}
+		}
+
+		ack := err
+		if err != nil {
+			w.failed.fail(err)
+			ack = w.failed.check()
+		}
+
+		for _, e := range group {
+			if e.logged != nil {
+				e.logged <- ack
+			}
+		}
+	}
+}
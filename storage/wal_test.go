@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	fs := newMemFS()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	model := mustNewFromFS(t, ctx, fs, testOptions)
+	for _, price := range []json.Number{"1.00", "2.00"} {
+		if err := model.UpdatePrice(ctx, "foo", price); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := model.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, _ := fs.Sub(WALSubdirectory).Files(); len(files) != 0 {
+		t.Error("WAL segments should be removed once all records are synced", files)
+	}
+
+	_, t0, _ := model.LastPrice(ctx, "foo")
+
+	// simulate a crash after logging records which weren't written to the
+	// results directory, the first of which was already written
+	segment := ""
+	for i, price := range []json.Number{"2.00", "3.00", "4.00"} {
+		by, _ := json.Marshal(record{ProductId: "foo", entry: entry{price, t0.Add(time.Duration(i) * time.Second)}})
+		segment += string(by) + "\n"
+	}
+	segment += `{"productId":"foo","newPr` // unacknowledged partial record
+	w, err := fs.New(walSegmentName(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(segment))
+	_ = w.Close()
+
+	model = mustNewFromFS(t, ctx, fs, testOptions)
+	if err := model.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, _ := fs.Sub(WALSubdirectory).Files(); len(files) != 0 {
+		t.Error("replayed WAL segments should be removed", files)
+	}
+
+	report, err := Check(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Records != 4 || len(report.Violations) != 0 {
+		t.Error("only records missing from results should have been replayed", report)
+	}
+
+	price, t1, _ := model.LastPrice(ctx, "foo")
+	if price != "4.00" || !t1.Equal(t0.Add(2*time.Second)) {
+		t.Error("replayed records should keep their original timestamps", price, t1)
+	}
+}
+
+func TestWALUnparseableSegment(t *testing.T) {
+	fs := newMemFS()
+	w, err := fs.New(filepath.Join(WALSubdirectory, "garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+
+	if model, err := newFromFS(context.Background(), fs, testOptions); err == nil {
+		_ = model.Close()
+		t.Error("startup should fail on a segment with an unparseable name")
+	}
+}